@@ -5,187 +5,6988 @@
 #cd go-gin-api-docker
 
 # Create main.go
-cat > main.go << EOL
+cat > main.go << 'EOL'
 package main
 
 import (
+    "bufio"
+    "bytes"
+    "compress/gzip"
+    "context"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/hmac"
+    cryptorand "crypto/rand"
+    "crypto/sha256"
+    "crypto/subtle"
     "database/sql"
+    "database/sql/driver"
+    "encoding/base64"
+    "encoding/csv"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "flag"
     "fmt"
+    "io"
     "log"
+    "log/slog"
+    "math"
+    "math/rand"
     "net/http"
+    "net/netip"
+    "net/url"
     "os"
+    "os/signal"
+    "reflect"
+    "regexp"
+    "sort"
     "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "syscall"
+    "time"
+    "unicode/utf8"
 
     "github.com/gin-gonic/gin"
-    _ "github.com/go-sql-driver/mysql"
+    "github.com/gin-gonic/gin/binding"
+    "github.com/go-playground/validator/v10"
+    "github.com/google/uuid"
+    "github.com/parquet-go/parquet-go"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promauto"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
     swaggerFiles "github.com/swaggo/files"
     ginSwagger "github.com/swaggo/gin-swagger"
     _ "example/api/docs" // replace with actual path to your docs package
 )
 
 type User struct {
-    ID    int    `json:"id"`
-    Name  string `json:"name"`
-    Email string `json:"email"`
+    ID    UserID `json:"id" parquet:"id"`
+    Name  string `json:"name" parquet:"name" binding:"required,max=100"`
+    Email string `json:"email" parquet:"email" binding:"required,email,max=100"`
+    // DeletedAt is only set on soft-deleted users, which are hidden unless
+    // an admin asks for them.
+    DeletedAt *time.Time `json:"deleted_at,omitempty" parquet:"deleted_at,optional"`
+    // UpdatedAt is maintained by MySQL and only set on users read back from
+    // the database.
+    UpdatedAt *time.Time `json:"updated_at,omitempty" parquet:"-"`
+    // IsDeleted mirrors DeletedAt != nil. It is only set on lists that may
+    // contain soft-deleted users, so clients need not inspect deleted_at.
+    IsDeleted *bool `json:"is_deleted,omitempty" parquet:"-"`
 }
 
+// userColumns are the columns read by scanUser, in order.
+const userColumns = "id, name, email, deleted_at, updated_at"
+
+// userPatch is the body accepted by PUT in merge mode, where any field may
+// be left out.
+type userPatch struct {
+    Name  string `json:"name" binding:"omitempty,max=100"`
+    Email string `json:"email" binding:"omitempty,email,max=100"`
+}
+
+// problem is an RFC 7807 problem details body, used instead of the
+// {"error": ...} envelope when ERROR_FORMAT=problem.
+type problem struct {
+    Type     string       `json:"type"`
+    Title    string       `json:"title"`
+    Status   int          `json:"status"`
+    Detail   string       `json:"detail,omitempty"`
+    Instance string       `json:"instance,omitempty"`
+    Fields   []fieldError `json:"fields,omitempty"`
+}
+
+// fieldError describes one field that failed validation.
+type fieldError struct {
+    Field   string `json:"field"`
+    Message string `json:"message"`
+}
+
+// UserID holds either an auto-increment integer or a UUID, depending on
+// ID_STRATEGY. Numeric IDs are serialized as JSON numbers so existing
+// clients keep working.
+type UserID string
+
+func (id UserID) MarshalJSON() ([]byte, error) {
+    if _, err := strconv.ParseInt(string(id), 10, 64); err == nil {
+        return []byte(id), nil
+    }
+    return json.Marshal(string(id))
+}
+
+func (id *UserID) UnmarshalJSON(data []byte) error {
+    if len(data) > 0 && data[0] == '"' {
+        var s string
+        if err := json.Unmarshal(data, &s); err != nil {
+            return err
+        }
+        *id = UserID(s)
+        return nil
+    }
+    // null means no ID, as for an omitted field.
+    if data = bytes.TrimSpace(data); string(data) == "null" {
+        *id = ""
+        return nil
+    }
+    *id = UserID(data)
+    return nil
+}
+
+// Scan accepts both INT and CHAR id columns.
+func (id *UserID) Scan(src any) error {
+    switch v := src.(type) {
+    case int64:
+        *id = UserID(strconv.FormatInt(v, 10))
+    case []byte:
+        *id = UserID(v)
+    case string:
+        *id = UserID(v)
+    default:
+        return fmt.Errorf("cannot scan %T into UserID", src)
+    }
+    return nil
+}
+
+const (
+    idStrategyAutoIncrement = "autoincrement"
+    idStrategyUUID          = "uuid"
+)
+
+// idStrategy selects how primary keys are generated: by MySQL
+// (AUTO_INCREMENT) or by the application (UUID stored as CHAR(36)).
+var idStrategy = idStrategyAutoIncrement
+
+// strictCreate rejects create bodies that carry an id instead of ignoring
+// it; see STRICT_CREATE.
+var strictCreate bool
+
+// createLimit is the creation-specific limiter set up by newRouter from
+// CREATE_RATE_LIMIT_RPS, or nil when creation isn't limited separately.
+var createLimit *creationLimiter
+
+// auditReads records every successful GET /users/:id in user_read_audit;
+// see AUDIT_READS.
+var auditReads bool
+
+// userList is the envelope returned by the list endpoint. Data holds []User,
+// or the projected users when the client asked for specific fields.
+type userList struct {
+    Data any      `json:"data"`
+    Meta listMeta `json:"meta"`
+}
+
+// selectableFields are the user fields a client may request with ?fields=.
+var selectableFields = map[string]bool{
+    "id":         true,
+    "name":       true,
+    "email":      true,
+    "deleted_at": true,
+    "updated_at": true,
+    "is_deleted": true,
+}
+
+// fieldsMaxCount and fieldsMaxLength bound the ?fields= parameter; see
+// FIELDS_MAX_COUNT and FIELDS_MAX_LENGTH.
+var (
+    fieldsMaxCount  = 10
+    fieldsMaxLength = 200
+)
+
+// listMeta describes the returned page. Total is only computed when the
+// client asks for it with with_count=true.
+type listMeta struct {
+    Limit        int           `json:"limit,omitempty"`
+    Offset       int           `json:"offset"`
+    Total        *int          `json:"total,omitempty"`
+    NextCursor   string        `json:"next_cursor,omitempty"`
+    Deprecations []deprecation `json:"deprecations,omitempty"`
+}
+
+// deprecation warns clients that a response field will be removed.
+type deprecation struct {
+    Field   string `json:"field"`
+    Message string `json:"message"`
+}
+
+// listParams holds the filters and paging accepted by the list endpoint.
+type listParams struct {
+    // IncludeDeleted also returns soft-deleted users; OnlyDeleted returns
+    // nothing else. Both are admin-only.
+    IncludeDeleted bool
+    OnlyDeleted    bool
+    IDs            []UserID
+    Email          string
+    CreatedBy      string
+    Search         string
+    Limit          int
+    Offset         int
+    WithCount      bool
+    // EmptyIs404 answers 404 instead of an empty page when nothing matches.
+    EmptyIs404 bool
+    // Bare answers with a plain array of users instead of userList, for
+    // clients written before the envelope. Paging is then only in headers.
+    Bare bool
+    // Tenant restricts the list to one tenant's users when set.
+    Tenant string
+    // ModifiedSince keeps only users updated at or after this time.
+    ModifiedSince *time.Time
+    // Fields limits each returned user to these fields when set.
+    Fields []string
+    Sort   listSort
+    // After continues a keyset-paginated list from just past this position.
+    After *listCursor
+}
+
+// listCursor is the position encoded in an opaque ?cursor= token: the sort
+// it belongs to and the sort column value and id of the last user returned.
+type listCursor struct {
+    Column string `json:"c"`
+    Desc   bool   `json:"d,omitempty"`
+    Value  string `json:"v"`
+    ID     UserID `json:"id"`
+}
+
+// cursorKey signs cursor tokens so clients can't forge positions. It is
+// random per process unless CURSOR_SECRET is set, which every instance
+// behind one load balancer needs to share for their cursors to carry over.
+var cursorKey = cursorSigningKey("")
+
+// cursorSigningKey derives the cursor key from secret, or returns a random
+// key when secret is empty.
+func cursorSigningKey(secret string) []byte {
+    if secret == "" {
+        key := make([]byte, sha256.Size)
+        if _, err := cryptorand.Read(key); err != nil {
+            panic(err)
+        }
+        return key
+    }
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte("list-cursor"))
+    return mac.Sum(nil)
+}
+
+// cursorColumns are the sort columns keyset pagination supports. deleted_at
+// is left out because NULLs don't compare.
+var cursorColumns = map[string]bool{
+    "id":   true,
+    "name": true,
+}
+
+// listSort orders a user list by Column, breaking ties by id so pages are
+// stable.
+type listSort struct {
+    Column string
+    Desc   bool
+}
+
+// sortableColumns whitelists the columns a list may be ordered by.
+var sortableColumns = map[string]bool{
+    "id":         true,
+    "name":       true,
+    "deleted_at": true,
+    "updated_at": true,
+}
+
+// indexedSortColumns are the sortable columns MySQL can order by with an
+// index rather than a filesort.
+var indexedSortColumns = map[string]bool{
+    "id":         true,
+    "deleted_at": true,
+    "updated_at": true,
+}
+
+// queryGuard enables checkListComplexity; see QUERY_GUARD. With it on, a
+// list sorted by a column without an index (name, email) is rejected unless
+// it filters on ids, email or created_by, whether or not it also searches.
+// An unindexed DEFAULT_SORT_COLUMN would fail every unfiltered list, so the
+// two can't be combined.
+var queryGuard bool
+
+// defaultSort is the order used when a request has no ?sort=; see
+// DEFAULT_SORT_COLUMN and DEFAULT_SORT_ORDER.
+var defaultSort = listSort{Column: "id"}
+
+// bulkUpdateRequest selects users by Filter and applies Set to all of them.
+type bulkUpdateRequest struct {
+    Filter bulkUpdateFilter  `json:"filter"`
+    Set    map[string]string `json:"set" binding:"required"`
+}
+
+// bulkUpdateFilter narrows a bulk update. At least one field must be set so
+// a missing filter can't rewrite the whole table.
+type bulkUpdateFilter struct {
+    EmailDomain string `json:"email_domain"`
+    CreatedBy   string `json:"created_by"`
+}
+
+// bulkUpdatableColumns whitelists the columns a bulk update may change.
+var bulkUpdatableColumns = map[string]bool{
+    "name": true,
+}
+
+// backfillRequest sets Field to Value on every row where it is NULL.
+// BatchSize overrides BACKFILL_BATCH_SIZE for this run.
+type backfillRequest struct {
+    Field     string `json:"field" binding:"required"`
+    Value     string `json:"value" binding:"required,max=100"`
+    BatchSize int    `json:"batch_size" binding:"omitempty,min=1,max=10000"`
+}
+
+// backfillableColumns whitelists the nullable columns a backfill may fill.
+var backfillableColumns = map[string]bool{
+    "created_by": true,
+}
+
+// backfillBatchSize is the default number of rows each backfill UPDATE
+// touches; see BACKFILL_BATCH_SIZE.
+var backfillBatchSize = 1000
+
+// bulkMaxBodyBytes caps the request body of bulk endpoints; see
+// BULK_MAX_BODY_BYTES.
+var bulkMaxBodyBytes int64 = 1 << 20
+
+// purgeBatchSize bounds each DELETE run by a purge so it never holds locks on
+// more than this many rows at once.
+const purgeBatchSize = 1000
+
+// maxListLimit is the largest page size a client may request.
+const maxListLimit = 100
+
+// maxListIDs caps how many users can be fetched at once with ?ids=.
+const maxListIDs = 100
+
+// exportWriter encodes users one at a time into an export stream.
+type exportWriter interface {
+    Write(user User) error
+    Flush() error
+    Close() error
+}
+
+type exportFormat struct {
+    contentType string
+    // newWriter starts an export; withDeleted adds the deleted_at column to
+    // formats whose layout is fixed up front.
+    newWriter func(w io.Writer, withDeleted bool) exportWriter
+}
+
+var exportFormats = map[string]exportFormat{
+    "csv":     {"text/csv", newCSVExportWriter},
+    "jsonl":   {"application/x-ndjson", newJSONLExportWriter},
+    "parquet": {"application/vnd.apache.parquet", newParquetExportWriter},
+}
+
+// exportDefaultFormat is the export format used when the request names none
+// and its Accept header is missing or */*; see EXPORT_DEFAULT_FORMAT.
+var exportDefaultFormat = "csv"
+
+// exportUnsupportedParams are list parameters that shape the JSON list
+// response and have no meaning for an export, which always has every
+// column and answers 200 even when empty.
+var exportUnsupportedParams = []string{"fields", "envelope", "empty_is_404", "with_count"}
+
+// exportFormatNames returns the supported export formats in sorted order.
+func exportFormatNames() []string {
+    names := make([]string, 0, len(exportFormats))
+    for name := range exportFormats {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// maxUserID is the largest value the signed INT id column can hold.
+const maxUserID = math.MaxInt32
+
+// exportFlushEvery is the number of rows written between flushes to the client.
+const exportFlushEvery = 500
+
+// nameMaxBytes and emailMaxBytes are the byte capacities of the name and
+// email columns. Multibyte UTF-8 text can pass the character limit and still
+// not fit, so bodies are checked against these before reaching MySQL. At
+// startup they are read from the schema, since they depend on the columns'
+// charset; these defaults, the declared widths, are what a single-byte
+// charset holds. NAME_MAX_BYTES and EMAIL_MAX_BYTES override both.
+var (
+    nameMaxBytes  = 100
+    emailMaxBytes = 255
+)
+
+// streamWriteTimeout bounds each write on streaming endpoints; see
+// deadlineWriter.
+var streamWriteTimeout = 10 * time.Second
+
+// consistentListReads makes lists with with_count=true read the total and
+// the page from one snapshot; see CONSISTENT_LIST_READS.
+var consistentListReads bool
+
+// streamLists makes unpaged lists stream their JSON instead of building it
+// in memory; see STREAM_LISTS and streamUserList.
+var streamLists bool
+
 var db *sql.DB
 
-// @title User API
-// @version 1.0
-// @description This is a sample User API with Swagger documentation
-// @host localhost:8080
-// @BasePath /api/v1
-func main() {
-    dbHost := os.Getenv("DB_HOST")
-    dbUser := os.Getenv("DB_USER")
-    dbPassword := os.Getenv("DB_PASSWORD")
-    dbName := os.Getenv("DB_NAME")
+// Business event counters, exposed on /metrics.
+var (
+    usersCreated = promauto.NewCounter(prometheus.CounterOpts{
+        Name: "users_created_total",
+        Help: "Users created.",
+    })
+    usersUpdated = promauto.NewCounter(prometheus.CounterOpts{
+        Name: "users_updated_total",
+        Help: "Users updated, counting each row of a bulk update.",
+    })
+    usersDeleted = promauto.NewCounter(prometheus.CounterOpts{
+        Name: "users_deleted_total",
+        Help: "Users soft-deleted.",
+    })
+    validationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+        Name: "validation_failures_total",
+        Help: "Request body fields rejected by validation, by field.",
+    }, []string{"field"})
+)
+
+// dbClosed is set just before db is closed at shutdown, so requests still
+// in flight get a 503 rather than "sql: database is closed".
+var dbClosed atomic.Bool
+
+// errDBUnavailable is reported while db is unset or closed.
+var errDBUnavailable = errors.New("database unavailable")
+
+// dbAvailable returns errDBUnavailable when db is nil or closed.
+func dbAvailable() error {
+    if db == nil || dbClosed.Load() {
+        return errDBUnavailable
+    }
+    return nil
+}
+
+// waitForDB pings db until it answers, backing off exponentially between
+// attempts, and gives up with the last error once timeout has passed. This
+// covers MySQL still starting when the app does, as under docker-compose.
+func waitForDB(timeout time.Duration) error {
+    deadline := time.Now().Add(timeout)
+    backoff := 250 * time.Millisecond
+    for attempt := 1; ; attempt++ {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        err := db.PingContext(ctx)
+        cancel()
+        if err == nil {
+            return nil
+        }
+        if time.Now().Add(backoff).After(deadline) {
+            return err
+        }
+        slog.Warn("database not ready, retrying", "attempt", attempt, "retry_in", backoff, "error", err)
+        time.Sleep(backoff)
+        backoff = min(backoff*2, 5*time.Second)
+    }
+}
+
+// closeDB marks db closed and then closes it.
+func closeDB() {
+    dbClosed.Store(true)
+    if err := db.Close(); err != nil {
+        log.Printf("closing database: %v", err)
+    }
+}
+
+// problemErrors switches error responses to application/problem+json.
+var problemErrors bool
+
+// camelJSON makes respondJSON rename snake_case keys to camelCase, for
+// clients that expect that convention. Set by JSON_NAMING=camel.
+var camelJSON bool
+
+// migrations bring databases created from an older init.sql up to the
+// current schema. They run in order and are recorded in schema_migrations;
+// append new entries and never edit applied ones. Statements use MariaDB's
+// IF NOT EXISTS forms so they are no-ops on a freshly initialized database.
+var migrations = []string{
+    "ALTER TABLE users ADD COLUMN IF NOT EXISTS created_by VARCHAR(100) NULL, ADD INDEX IF NOT EXISTS idx_users_created_by (created_by)",
+    "ALTER TABLE users MODIFY email VARCHAR(255) NOT NULL, ADD COLUMN IF NOT EXISTS email_hash CHAR(64) NULL, ADD INDEX IF NOT EXISTS idx_users_email_hash (email_hash)",
+    "ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at DATETIME NULL, ADD INDEX IF NOT EXISTS idx_users_deleted_at (deleted_at)",
+    "ALTER TABLE users ADD COLUMN IF NOT EXISTS tenant_id VARCHAR(64) NULL, ADD INDEX IF NOT EXISTS idx_users_tenant_id (tenant_id)",
+    "ALTER TABLE users ADD COLUMN IF NOT EXISTS updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP, ADD INDEX IF NOT EXISTS idx_users_updated_at (updated_at)",
+    "CREATE TABLE IF NOT EXISTS user_read_audit (id BIGINT AUTO_INCREMENT PRIMARY KEY, user_id VARCHAR(36) NOT NULL, accessor VARCHAR(100) NULL, tenant_id VARCHAR(64) NULL, request_id VARCHAR(64) NOT NULL, read_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP, INDEX idx_user_read_audit_user_id (user_id, read_at))",
+}
+
+// likeEscaper makes %, _ and the escape character itself match literally in
+// a LIKE pattern.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// actorKey is the context key under which authentication middleware stores
+// the caller's ID. Users created without one have a NULL created_by.
+const actorKey = "actor"
+
+// tenantKey is the context key holding the caller's tenant, when it has one.
+// Every query on users is then limited to that tenant.
+const tenantKey = "tenant"
+
+// scopesKey is the context key holding the authenticated caller's scopes.
+const scopesKey = "scopes"
+
+// requestIDKey is the context key holding the request's X-Request-ID.
+const requestIDKey = "request_id"
+
+// lockConnKey is the context key holding the *sql.Conn that owns the
+// user's advisory lock, when USER_LOCKS is on.
+const lockConnKey = "lock_conn"
+
+// queryComments makes tagQuery prefix SQL with the request ID; see
+// DB_QUERY_COMMENTS.
+var queryComments bool
+
+// apiKey is one entry of the API_KEYS JSON array. Name identifies the caller
+// in created_by and logs; the key itself is never stored.
+type apiKey struct {
+    Name   string   `json:"name"`
+    Key    string   `json:"key"`
+    Scopes []string `json:"scopes"`
+    // Tenant pins the key to one tenant; X-Tenant-ID can't override it.
+    Tenant string `json:"tenant,omitempty"`
+}
+
+// runtimeConfig holds the settings that can be changed without a restart by
+// editing CONFIG_FILE and sending the process SIGHUP.
+type runtimeConfig struct {
+    // HealthAlways200 makes /readyz answer 200 even when a dependency is
+    // down, for load balancers that only look at the body.
+    HealthAlways200 bool
+    // SearchMaxLength caps the length, in characters, of the list endpoint's
+    // search term so a huge pattern can't turn into a slow LIKE scan.
+    SearchMaxLength       int
+    ClientErrorSampleRate float64
+    CacheControlList      string
+    CacheControlItem      string
+    LogLevel              slog.Level
+    // Deprecations come from DEPRECATED_FIELDS, a JSON object mapping a
+    // response field to a message for clients still reading it.
+    Deprecations []deprecation
+}
+
+// reloadableKeys are the variables a SIGHUP re-reads from CONFIG_FILE. Any
+// other key in the file only takes effect at startup.
+var reloadableKeys = map[string]bool{
+    "HEALTH_ALWAYS_200":   true,
+    "SEARCH_MAX_LENGTH":   true,
+    "LOG_4XX_SAMPLE_RATE": true,
+    "CACHE_CONTROL_LIST":  true,
+    "CACHE_CONTROL_ITEM":  true,
+    "LOG_LEVEL":           true,
+    "DEPRECATED_FIELDS":   true,
+}
+
+var activeConfig atomic.Pointer[runtimeConfig]
+
+// poolHealthConfig sets when the background pool checker warns. A warning
+// is logged when WaitCount grew by at least WaitCountIncrease during one
+// Interval, or when InUse reaches InUseRatio of the open-connection limit.
+type poolHealthConfig struct {
+    Interval          time.Duration
+    WaitCountIncrease int64
+    InUseRatio        float64
+}
+
+// piiCipher encrypts emails at rest when ENCRYPT_PII is enabled. When nil,
+// emails are stored in plain text.
+var piiCipher *emailCipher
+
+// emailCipher encrypts emails with AES-GCM and derives a keyed hash of the
+// normalized address for the indexed email_hash column, since ciphertext
+// can't be matched exactly.
+type emailCipher struct {
+    aead    cipher.AEAD
+    hashKey []byte
+}
+
+// chaosConfig controls fault injection for resilience testing. It is only
+// honoured outside release mode.
+type chaosConfig struct {
+    // Routes are matched against the route pattern, e.g. /api/v1/users/:id.
+    // Empty means every route.
+    Routes      map[string]bool
+    ErrorRate   float64
+    LatencyRate float64
+    Latency     time.Duration
+}
+
+// logLevel is the level of the default slog handler, swapped on reload.
+var logLevel slog.LevelVar
+
+// currentConfig returns the active runtime configuration.
+func currentConfig() *runtimeConfig {
+    return activeConfig.Load()
+}
+
+// @title User API
+// @version 1.0
+// @description This is a sample User API with Swagger documentation
+// @host localhost:8080
+// @BasePath /api/v1
+func main() {
+    migrateFlag := flag.Bool("migrate-only", false, "apply pending migrations and exit without serving")
+    flag.Parse()
+    migrateOnly := *migrateFlag || os.Getenv("MODE") == "migrate"
+
+    configFile := os.Getenv("CONFIG_FILE")
+    if configFile != "" {
+        if err := applyConfigFile(configFile, false); err != nil {
+            log.Fatal(err)
+        }
+    }
+    slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: &logLevel})))
+    activeConfig.Store(loadRuntimeConfig())
+    go watchReload(configFile)
+
+    switch v := os.Getenv("ERROR_FORMAT"); v {
+    case "", "envelope":
+    case "problem":
+        problemErrors = true
+    default:
+        log.Fatalf("invalid ERROR_FORMAT %q", v)
+    }
+    switch v := os.Getenv("JSON_NAMING"); v {
+    case "", "snake":
+    case "camel":
+        camelJSON = true
+    default:
+        log.Fatalf("invalid JSON_NAMING %q", v)
+    }
+
+    streamWriteTimeout = envDuration("STREAM_WRITE_TIMEOUT", streamWriteTimeout)
+    streamLists = envBool("STREAM_LISTS")
+    consistentListReads = envBool("CONSISTENT_LIST_READS")
+    if v := os.Getenv("EXPORT_DEFAULT_FORMAT"); v != "" {
+        if _, ok := exportFormats[v]; !ok {
+            log.Fatalf("invalid EXPORT_DEFAULT_FORMAT %q", v)
+        }
+        exportDefaultFormat = v
+    }
+    backfillBatchSize = envInt("BACKFILL_BATCH_SIZE", backfillBatchSize)
+    // A batch of zero would update nothing and loop forever.
+    if backfillBatchSize < 1 {
+        log.Fatalf("invalid BACKFILL_BATCH_SIZE %d", backfillBatchSize)
+    }
+    bulkMaxBodyBytes = int64(envInt("BULK_MAX_BODY_BYTES", int(bulkMaxBodyBytes)))
+    fieldsMaxCount = envInt("FIELDS_MAX_COUNT", fieldsMaxCount)
+    fieldsMaxLength = envInt("FIELDS_MAX_LENGTH", fieldsMaxLength)
+    strictCreate = envBool("STRICT_CREATE")
+    auditReads = envBool("AUDIT_READS")
+    queryGuard = envBool("QUERY_GUARD")
+    if v := os.Getenv("DEFAULT_SORT_COLUMN"); v != "" {
+        if !sortableColumns[v] {
+            log.Fatalf("invalid DEFAULT_SORT_COLUMN %q", v)
+        }
+        defaultSort.Column = v
+    }
+    switch v := os.Getenv("DEFAULT_SORT_ORDER"); v {
+    case "", "asc":
+    case "desc":
+        defaultSort.Desc = true
+    default:
+        log.Fatalf("invalid DEFAULT_SORT_ORDER %q", v)
+    }
+    if queryGuard {
+        if err := checkGuardedDefaultSort(defaultSort); err != nil {
+            log.Fatal(err)
+        }
+    }
+    dbReadOnlyRetryAfter = envDuration("DB_READ_ONLY_RETRY_AFTER", dbReadOnlyRetryAfter)
+
+    dbHost := os.Getenv("DB_HOST")
+    dbUser := os.Getenv("DB_USER")
+    dbPassword := os.Getenv("DB_PASSWORD")
+    dbName := os.Getenv("DB_NAME")
+
+    if v := os.Getenv("ID_STRATEGY"); v != "" {
+        if v != idStrategyAutoIncrement && v != idStrategyUUID {
+            log.Fatalf("invalid ID_STRATEGY %q", v)
+        }
+        idStrategy = v
+    }
+
+    if envBool("ENCRYPT_PII") {
+        key, err := base64.StdEncoding.DecodeString(os.Getenv("ENCRYPTION_KEY"))
+        if err != nil {
+            log.Fatalf("invalid ENCRYPTION_KEY: %v", err)
+        }
+        if piiCipher, err = newEmailCipher(key); err != nil {
+            log.Fatalf("invalid ENCRYPTION_KEY: %v", err)
+        }
+    }
+
+    if v := os.Getenv("CURSOR_SECRET"); v != "" {
+        cursorKey = cursorSigningKey(v)
+    }
+
+    var err error
+    db, err = sql.Open(driverName, buildDSN(dbHost, dbUser, dbPassword, dbName))
+    if err != nil {
+        log.Fatal(err)
+    }
+    defer closeDB()
+    db.SetMaxOpenConns(envInt("DB_MAX_OPEN_CONNS", 0))
+    db.SetMaxIdleConns(envInt("DB_MAX_IDLE_CONNS", 2))
+    db.SetConnMaxLifetime(envDuration("DB_CONN_MAX_LIFETIME", 0))
+    db.SetConnMaxIdleTime(envDuration("DB_CONN_MAX_IDLE_TIME", 0))
+    if err := waitForDB(envDuration("DB_STARTUP_RETRY_TIMEOUT", 30*time.Second)); err != nil {
+        log.Fatalf("database unreachable: %v", err)
+    }
+
+    // A read-only deployment typically points at a replica, which can't
+    // apply migrations; the primary's deployment does that.
+    readOnly := envBool("READ_ONLY")
+    if readOnly && auditReads {
+        log.Fatal("AUDIT_READS writes to the database and can't be combined with READ_ONLY")
+    }
+    serve, err := prepareSchema(readOnly, migrateOnly)
+    if err != nil {
+        log.Fatal(err)
+    }
+    if !serve {
+        return
+    }
+    // Read after migrating, since a migration may have widened a column.
+    if err := loadColumnByteLimits(); err != nil {
+        slog.Warn("reading column sizes failed, using the defaults", "error", err)
+    }
+    nameMaxBytes = envInt("NAME_MAX_BYTES", nameMaxBytes)
+    emailMaxBytes = envInt("EMAIL_MAX_BYTES", emailMaxBytes)
+
+    useJSONFieldNames()
+
+    var apiKeys []apiKey
+    if v := os.Getenv("API_KEYS"); v != "" {
+        if err := json.Unmarshal([]byte(v), &apiKeys); err != nil {
+            log.Fatalf("invalid API_KEYS: %v", err)
+        }
+    }
+
+    api, admin := newRouter(readOnly, apiKeys)
+
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+
+    go monitorPool(ctx, poolHealthConfig{
+        Interval:          envDuration("POOL_CHECK_INTERVAL", 30*time.Second),
+        WaitCountIncrease: int64(envInt("POOL_WAIT_COUNT_THRESHOLD", 1)),
+        InUseRatio:        envFloat("POOL_IN_USE_RATIO", 0.9),
+    })
+
+    servers := []*http.Server{{Addr: ":8080", Handler: api}}
+    if admin != nil {
+        servers = append(servers, &http.Server{Addr: os.Getenv("ADMIN_LISTEN_ADDR"), Handler: admin})
+    }
+    for _, srv := range servers {
+        go func(srv *http.Server) {
+            if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+                log.Fatal(err)
+            }
+        }(srv)
+    }
+
+    <-ctx.Done()
+    shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    var wg sync.WaitGroup
+    for _, srv := range servers {
+        wg.Add(1)
+        go func(srv *http.Server) {
+            defer wg.Done()
+            if err := srv.Shutdown(shutdownCtx); err != nil {
+                log.Printf("shutdown %s: %v", srv.Addr, err)
+            }
+        }(srv)
+    }
+    wg.Wait()
+}
+
+// newRouter builds the public API engine from the environment, along with
+// the admin engine serving readiness and metrics when ADMIN_LISTEN_ADDR is
+// set. admin is nil otherwise, and those routes are on api.
+func newRouter(readOnly bool, apiKeys []apiKey) (api, admin *gin.Engine) {
+    requestLimit := limitConcurrent(envInt("MAX_CONCURRENT_REQUESTS", 0), envLimitMode("CONCURRENCY_LIMIT_MODE"), "Too many concurrent requests")
+    streamLimit := limitConcurrent(envInt("MAX_STREAM_CONNS", 100), envLimitMode("STREAM_LIMIT_MODE"), "Too many concurrent streams")
+    createLimit = nil
+    if rps := envFloat("CREATE_RATE_LIMIT_RPS", 0); rps > 0 {
+        var verifier humanVerifier
+        if verifyURL := os.Getenv("CAPTCHA_VERIFY_URL"); verifyURL != "" {
+            verifier = siteverify{url: verifyURL, secret: os.Getenv("CAPTCHA_SECRET"), client: &http.Client{Timeout: 5 * time.Second}}
+        }
+        createLimit = &creationLimiter{limiter: newRateLimiter(rps, envInt("CREATE_RATE_LIMIT_BURST", int(math.Ceil(rps)))), verifier: verifier}
+    }
+    userLock := func(c *gin.Context) { c.Next() }
+    if envBool("USER_LOCKS") {
+        userLock = serializeUserWrites(envDuration("USER_LOCK_TIMEOUT", 5*time.Second))
+    }
+
+    var limiter *rateLimiter
+    if rps := envFloat("RATE_LIMIT_RPS", 0); rps > 0 {
+        limiter = newRateLimiter(rps, envInt("RATE_LIMIT_BURST", int(math.Ceil(rps))))
+    }
+
+    r := gin.New()
+    // Gin trusts every proxy by default, which would let any client pick
+    // its own ClientIP, and with it its rate limit buckets, through
+    // X-Forwarded-For. Without TRUSTED_PROXIES the peer address is used.
+    if err := r.SetTrustedProxies(nil); err != nil {
+        log.Fatal(err)
+    }
+    trustedProxies = nil
+    if v := os.Getenv("TRUSTED_PROXIES"); v != "" {
+        proxies := strings.Split(v, ",")
+        for i, p := range proxies {
+            proxies[i] = strings.TrimSpace(p)
+            prefix, err := parseProxyPrefix(proxies[i])
+            if err != nil {
+                log.Fatalf("invalid TRUSTED_PROXIES: %v", err)
+            }
+            trustedProxies = append(trustedProxies, prefix)
+        }
+        if err := r.SetTrustedProxies(proxies); err != nil {
+            log.Fatalf("invalid TRUSTED_PROXIES: %v", err)
+        }
+    }
+    // Route /api//v1/users and the like as if the slashes were single.
+    r.RemoveExtraSlash = true
+    if v := os.Getenv("LOG_FORMAT"); v == "" {
+        r.Use(gin.Logger())
+    } else if formatter, ok := accessLogFormatters[v]; ok {
+        r.Use(gin.LoggerWithFormatter(formatter))
+    } else {
+        log.Fatalf("invalid LOG_FORMAT %q", v)
+    }
+    queryComments = envBool("DB_QUERY_COMMENTS")
+    r.Use(gin.Recovery(), requestID(), errorLogger(), securityHeaders(loadSecurityHeaders()), limitQueryParams(envInt("MAX_QUERY_PARAMS", 100)))
+    if readOnly {
+        r.Use(rejectWrites())
+    }
+    gzipEnabled := envBool("GZIP_ENABLED")
+    if gzipEnabled {
+        r.Use(gzipResponses())
+    }
+    if envBool("CHAOS_ENABLED") {
+        if err := checkDebugOnly("CHAOS_ENABLED"); err != nil {
+            log.Fatal(err)
+        }
+        r.Use(chaos(loadChaosConfig()))
+    }
+    if ms := envInt("SIMULATE_LATENCY_MS", 0); ms > 0 {
+        if err := checkDebugOnly("SIMULATE_LATENCY_MS"); err != nil {
+            log.Fatal(err)
+        }
+        r.Use(simulateLatency(time.Duration(ms)*time.Millisecond, routeSet(os.Getenv("SIMULATE_LATENCY_ROUTES"))))
+    }
+
+    v1 := r.Group("/api/v1", requestLimit, requireDB(), apiKeyAuth(apiKeys), deprecationWarnings())
+    multiTenant := envBool("MULTI_TENANT")
+    if multiTenant {
+        trustHeader := envBool("TRUST_TENANT_HEADER")
+        if err := checkTenantPinning(apiKeys, trustHeader); err != nil {
+            log.Fatal(err)
+        }
+        v1.Use(resolveTenant(trustHeader))
+    }
+    v1.GET("/meta", metaHandler(limiter, serverFeatures{
+        ReadOnly:        readOnly,
+        MultiTenant:     multiTenant,
+        IDStrategy:      idStrategy,
+        EncryptedEmails: piiCipher != nil,
+        StrictCreate:    strictCreate,
+        Gzip:            gzipEnabled,
+        ExportFormats:   exportFormatNames(),
+        MaxListLimit:    maxListLimit,
+    }))
+    v1.GET("/schema", schemaHandler(apiSchema()))
+    {
+        users := v1.Group("/users")
+        if limiter != nil {
+            users.Use(rateLimit(limiter))
+            v1.GET("/ratelimit", rateLimitStatusHandler(limiter))
+        }
+        if multiTenant {
+            users.Use(limitTenantQueries(envInt("TENANT_DB_BUDGET", 0), envDuration("TENANT_DB_BUDGET_WAIT", time.Second)))
+        }
+        {
+            users.GET("", requireScope("users:read"), cacheControl(func(cfg *runtimeConfig) string { return cfg.CacheControlList }), getUsers)
+            users.HEAD("", requireScope("users:read"), cacheControl(func(cfg *runtimeConfig) string { return cfg.CacheControlList }), headUsers)
+            users.GET("/export", requireScope("users:read"), streamLimit, exportUsers)
+            users.GET("/deleted", requireScope("users:admin"), getDeletedUsers)
+            users.DELETE("/deleted", requireScope("users:admin"), purgeDeletedUsers)
+            users.GET("/:id", requireScope("users:read"), cacheControl(func(cfg *runtimeConfig) string { return cfg.CacheControlItem }), getUser)
+            users.POST("", requireScope("users:write"), createUser)
+            users.POST("/bulk", requireScope("users:write"), limitBody(bulkMaxBodyBytes), bulkCreateUsers)
+            users.POST("/bulk-update", requireScope("users:admin"), limitBody(bulkMaxBodyBytes), bulkUpdateUsers)
+            users.POST("/backfill", requireScope("users:admin"), backfillUsers)
+            users.PUT("/:id", requireScope("users:write"), userLock, updateUser)
+            users.DELETE("/:id", requireScope("users:write"), userLock, deleteUser)
+        }
+    }
+
+    healthPrefix := strings.TrimSuffix(os.Getenv("HEALTH_PATH_PREFIX"), "/")
+    metricsPath := envString("METRICS_PATH", "/metrics")
+    if (healthPrefix != "" && !strings.HasPrefix(healthPrefix, "/")) || !strings.HasPrefix(metricsPath, "/") {
+        log.Fatal("HEALTH_PATH_PREFIX and METRICS_PATH must start with /")
+    }
+    // With ADMIN_LISTEN_ADDR set, readiness and metrics move to their own
+    // listener so they can be firewalled off from the public API.
+    internal := r
+    if os.Getenv("ADMIN_LISTEN_ADDR") != "" {
+        admin = gin.New()
+        admin.Use(gin.Recovery())
+        internal = admin
+    }
+    internal.GET(healthPrefix+"/readyz", readyz)
+    internal.GET(metricsPath, gin.WrapH(promhttp.Handler()))
+    r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
+    return r, admin
+}
+
+// @Summary Get all users
+// @Description Get a page of users. Without limit every matching user is returned.
+// @Produce json
+// @Param ids query string false "Comma-separated user IDs to fetch; unknown IDs are skipped"
+// @Param email query string false "Only the user with exactly this email"
+// @Param created_by query string false "Only users created by this actor"
+// @Param search query string false "Match a substring of the name, or of the email when it isn't encrypted"
+// @Param limit query int false "Maximum number of users to return"
+// @Param offset query int false "Number of users to skip"
+// @Param with_count query bool false "Include the total number of matching users"
+// @Param include_deleted query bool false "Also return soft-deleted users (admin only)"
+// @Param modified_since query string false "RFC 3339 time; only users updated at or after it, ordered by updated_at unless sort is given"
+// @Param empty_is_404 query bool false "Answer 404 instead of an empty list when nothing matches"
+// @Param fields query string false "Comma-separated fields to return (id, name, email, deleted_at, updated_at, is_deleted)"
+// @Param sort query string false "Column to order by (id, name, deleted_at, updated_at); prefix with - for descending"
+// @Param cursor query string false "meta.next_cursor from the previous page, for keyset pagination; requires limit"
+// @Param envelope query bool false "false returns a bare array of users with paging only in headers, as does Accept: application/json; profile=bare. Defaults to true"
+// @Success 200 {object} userList{data=[]User}
+// @Failure 404 {object} map[string]string
+// @Header 200 {int} X-Total-Count "Number of matching users, when with_count=true"
+// @Header 200 {string} Link "first, prev, next and last pages, when limit is set"
+// @Header 200 {string} X-Next-Cursor "meta.next_cursor, for bare responses"
+// @Router /users [get]
+func getUsers(c *gin.Context) {
+    p, ok := parseListParams(c)
+    if !ok {
+        return
+    }
+    listUsers(c, p)
+}
+
+// @Summary Get deleted users
+// @Description Get a page of soft-deleted users for review before they are purged
+// @Produce json
+// @Param search query string false "Match a substring of the name or email"
+// @Param limit query int false "Maximum number of users to return"
+// @Param offset query int false "Number of users to skip"
+// @Param with_count query bool false "Include the total number of matching users"
+// @Success 200 {object} userList{data=[]User}
+// @Router /users/deleted [get]
+func getDeletedUsers(c *gin.Context) {
+    p, ok := parseListParams(c)
+    if !ok {
+        return
+    }
+    p.OnlyDeleted = true
+    listUsers(c, p)
+}
+
+// @Summary Backfill a column
+// @Description Set a whitelisted nullable field to a value on every row where it is NULL, in batches
+// @Accept json
+// @Produce json
+// @Param request body backfillRequest true "Field, value and optional batch size"
+// @Success 200 {object} map[string]any
+// @Failure 400 {object} map[string]string
+// @Router /users/backfill [post]
+func backfillUsers(c *gin.Context) {
+    var req backfillRequest
+    if !bindJSON(c, &req) {
+        return
+    }
+    if !backfillableColumns[req.Field] {
+        respondError(c, http.StatusBadRequest, "field "+strconv.Quote(req.Field)+" can't be backfilled")
+        return
+    }
+    batchSize := req.BatchSize
+    if batchSize == 0 {
+        batchSize = backfillBatchSize
+    }
+
+    // Each batch is its own statement so row locks are released between them.
+    var updated int64
+    batches := 0
+    for {
+        tenant, tenantArgs := tenantCond(c)
+        args := append(append([]any{req.Value}, tenantArgs...), batchSize)
+        result, err := db.ExecContext(c.Request.Context(), tagQuery(c, "UPDATE users SET "+req.Field+" = ? WHERE "+req.Field+" IS NULL"+tenant+" LIMIT ?"), args...)
+        if err != nil {
+            respondDBError(c, err)
+            return
+        }
+        n, _ := result.RowsAffected()
+        updated += n
+        batches++
+        slog.Info("backfill progress", "field", req.Field, "batch", batches, "updated", updated)
+        if n < int64(batchSize) {
+            break
+        }
+    }
+    respondJSON(c, http.StatusOK, gin.H{"field": req.Field, "updated": updated, "batches": batches})
+}
+
+// @Summary Purge deleted users
+// @Description Permanently remove users that were soft-deleted longer ago than older_than
+// @Produce json
+// @Param older_than query string true "Minimum time since deletion, e.g. 30d or 12h"
+// @Success 200 {object} map[string]int64
+// @Failure 400 {object} map[string]string
+// @Router /users/deleted [delete]
+func purgeDeletedUsers(c *gin.Context) {
+    olderThan, err := parseRetention(c.Query("older_than"))
+    if err != nil {
+        respondError(c, http.StatusBadRequest, "older_than: "+err.Error())
+        return
+    }
+
+    // The cutoff is computed by MySQL so it uses the same clock as the
+    // NOW() that set deleted_at.
+    ctx := c.Request.Context()
+    var purged int64
+    for {
+        tenant, tenantArgs := tenantCond(c)
+        args := append(append([]any{int64(olderThan.Seconds())}, tenantArgs...), purgeBatchSize)
+        result, err := db.ExecContext(ctx, tagQuery(c, "DELETE FROM users WHERE deleted_at IS NOT NULL AND deleted_at < NOW() - INTERVAL ? SECOND"+tenant+" LIMIT ?"), args...)
+        if err != nil {
+            respondDBError(c, err)
+            return
+        }
+        n, _ := result.RowsAffected()
+        purged += n
+        if n < purgeBatchSize {
+            break
+        }
+        // No further batch is started once the request is canceled or has
+        // timed out; the batches already run stay purged.
+        if err := ctx.Err(); err != nil {
+            slog.Warn("purge stopped", "purged", purged, "error", err)
+            c.Abort()
+            return
+        }
+    }
+    respondJSON(c, http.StatusOK, gin.H{"purged": purged})
+}
+
+// parseRetention parses a positive duration, accepting a whole number of days
+// ("30d") as well as anything time.ParseDuration understands.
+func parseRetention(s string) (time.Duration, error) {
+    if s == "" {
+        return 0, errors.New("is required")
+    }
+    var d time.Duration
+    if days, ok := strings.CutSuffix(s, "d"); ok {
+        n, err := strconv.Atoi(days)
+        if err != nil {
+            return 0, fmt.Errorf("invalid duration %q", s)
+        }
+        d = time.Duration(n) * 24 * time.Hour
+    } else {
+        var err error
+        if d, err = time.ParseDuration(s); err != nil {
+            return 0, fmt.Errorf("invalid duration %q", s)
+        }
+    }
+    if d <= 0 {
+        return 0, errors.New("must be positive")
+    }
+    return d, nil
+}
+
+// listUsers writes the page of users selected by p.
+func listUsers(c *gin.Context, p listParams) {
+    // Accept can select the bare profile, so caches must key on it.
+    c.Writer.Header().Add("Vary", "Accept")
+    where, args := p.where()
+
+    // The count and the page are separate statements; with
+    // CONSISTENT_LIST_READS they read one snapshot, so a concurrent write
+    // can't make the total disagree with the rows.
+    ctx := c.Request.Context()
+    var q queryer = db
+    if p.WithCount && consistentListReads {
+        conn, end, err := beginSnapshot(ctx)
+        if err != nil {
+            respondDBError(c, err)
+            return
+        }
+        defer end()
+        q = conn
+    }
+
+    meta := listMeta{Limit: p.Limit, Offset: p.Offset, Deprecations: currentConfig().Deprecations}
+    if p.WithCount {
+        var total int
+        if err := q.QueryRowContext(ctx, tagQuery(c, "SELECT COUNT(*) FROM users"+where), args...).Scan(&total); err != nil {
+            respondDBError(c, err)
+            return
+        }
+        meta.Total = &total
+    }
+
+    users := []User{}
+    rows, err := q.QueryContext(ctx, tagQuery(c, "SELECT "+userColumns+" FROM users"+where+p.orderBy()+p.limitClause()), args...)
+    if err != nil {
+        respondDBError(c, err)
+        return
+    }
+    defer rows.Close()
+    if streamLists && p.Limit == 0 {
+        streamUserList(c, p, rows, meta)
+        return
+    }
+
+    for rows.Next() {
+        user, err := scanUser(rows)
+        if err != nil {
+            respondDBError(c, err)
+            return
+        }
+        users = append(users, p.present(user))
+    }
+    if p.EmptyIs404 && len(users) == 0 {
+        respondError(c, http.StatusNotFound, "No users matched")
+        return
+    }
+
+    hasMore := p.Limit > 0 && len(users) == p.Limit
+    if hasMore {
+        meta.NextCursor = p.nextCursor(users[len(users)-1])
+    }
+    if meta.Total != nil {
+        hasMore = p.Limit > 0 && p.Offset+len(users) < *meta.Total
+    }
+    setPaginationHeaders(c, p, meta.Total, hasMore)
+    var data any = users
+    if p.Fields != nil {
+        projected := make([]map[string]any, len(users))
+        for i, user := range users {
+            projected[i] = projectUser(user, p.Fields)
+        }
+        data = projected
+    }
+    if p.Bare {
+        if meta.NextCursor != "" {
+            c.Header("X-Next-Cursor", meta.NextCursor)
+        }
+        respondJSON(c, http.StatusOK, data)
+        return
+    }
+    respondJSON(c, http.StatusOK, userList{Data: data, Meta: meta})
+}
+
+// acceptsBareProfile reports whether an Accept header asks for JSON with
+// profile=bare, the pre-envelope list format.
+func acceptsBareProfile(accept string) bool {
+    for _, part := range negotiationEntries(accept) {
+        typ, params, _ := strings.Cut(part, ";")
+        typ = strings.ToLower(strings.TrimSpace(typ))
+        if typ != "application/json" && typ != "*/*" {
+            continue
+        }
+        for _, param := range strings.Split(params, ";") {
+            k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+            if strings.EqualFold(strings.TrimSpace(k), "profile") && strings.Trim(strings.TrimSpace(v), `"`) == "bare" {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// streamUserList writes an unpaged list as its rows are read, so memory use
+// doesn't grow with the number of users. The body matches userList, but
+// once it has started a failure can only be logged, leaving the client a
+// truncated document.
+func streamUserList(c *gin.Context, p listParams, rows *sql.Rows, meta listMeta) {
+    // The first row is read up front so an empty or failed query can still
+    // get a proper status.
+    more := rows.Next()
+    if !more {
+        if err := rows.Err(); err != nil {
+            respondDBError(c, err)
+            return
+        }
+        if p.EmptyIs404 {
+            respondError(c, http.StatusNotFound, "No users matched")
+            return
+        }
+    }
+    setPaginationHeaders(c, p, meta.Total, false)
+    c.Header("Content-Type", "application/json; charset=utf-8")
+    c.Status(http.StatusOK)
+
+    out := newDeadlineWriter(c.Writer, streamWriteTimeout)
+    defer out.Close()
+    w := bufio.NewWriter(out)
+    if p.Bare {
+        w.WriteByte('[')
+    } else {
+        w.WriteString(`{"data":[`)
+    }
+    for n := 0; more; n++ {
+        user, err := scanUser(rows)
+        if err != nil {
+            log.Printf("list: %v", err)
+            return
+        }
+        user = p.present(user)
+        var v any = user
+        if p.Fields != nil {
+            v = projectUser(user, p.Fields)
+        }
+        b, err := marshalResponse(v)
+        if err != nil {
+            log.Printf("list: %v", err)
+            return
+        }
+        if n > 0 {
+            w.WriteByte(',')
+        }
+        w.Write(b)
+        if (n+1)%exportFlushEvery == 0 {
+            if err := w.Flush(); err != nil {
+                log.Printf("list: %v", err)
+                return
+            }
+            if err := out.Flush(); err != nil {
+                log.Printf("list: %v", err)
+                return
+            }
+        }
+        more = rows.Next()
+    }
+    if err := rows.Err(); err != nil {
+        log.Printf("list: %v", err)
+        return
+    }
+    if p.Bare {
+        w.WriteByte(']')
+    } else {
+        b, err := marshalResponse(meta)
+        if err != nil {
+            log.Printf("list: %v", err)
+            return
+        }
+        w.WriteString(`],"meta":`)
+        w.Write(b)
+        w.WriteByte('}')
+    }
+    if err := w.Flush(); err != nil {
+        log.Printf("list: %v", err)
+        return
+    }
+    if err := out.Flush(); err != nil {
+        log.Printf("list: %v", err)
+    }
+}
+
+// present prepares a user read for p's list: lists that may contain
+// soft-deleted users mark each one with is_deleted.
+func (p listParams) present(user User) User {
+    if p.IncludeDeleted || p.OnlyDeleted {
+        deleted := user.DeletedAt != nil
+        user.IsDeleted = &deleted
+    }
+    return user
+}
+
+// @Summary Count users
+// @Description Return the list endpoint's headers without a body, using only a count query
+// @Param created_by query string false "Only users created by this actor"
+// @Param search query string false "Match a substring of the name or email"
+// @Param limit query int false "Page size used to build the Link header"
+// @Param offset query int false "Number of users to skip"
+// @Success 200 "OK"
+// @Header 200 {int} X-Total-Count "Number of matching users"
+// @Header 200 {string} Link "first, prev, next and last pages, when limit is set"
+// @Router /users [head]
+func headUsers(c *gin.Context) {
+    p, ok := parseListParams(c)
+    if !ok {
+        return
+    }
+    where, args := p.where()
+
+    var total int
+    if err := db.QueryRow(tagQuery(c, "SELECT COUNT(*) FROM users"+where), args...).Scan(&total); err != nil {
+        respondDBError(c, err)
+        return
+    }
+    setPaginationHeaders(c, p, &total, p.Limit > 0 && p.Offset+p.Limit < total)
+    c.Header("Content-Type", "application/json; charset=utf-8")
+    c.Status(http.StatusOK)
+}
+
+// @Summary Get a user
+// @Description Get a user by ID
+// @Produce json
+// @Param id path int true "User ID"
+// @Param fields query string false "Comma-separated fields to return (id, name, email, deleted_at, updated_at)"
+// @Success 200 {object} User
+// @Router /users/{id} [get]
+func getUser(c *gin.Context) {
+    id, ok := parseUserID(c)
+    if !ok {
+        return
+    }
+    fields, ok := parseFields(c)
+    if !ok {
+        return
+    }
+    tenant, tenantArgs := tenantCond(c)
+    user, err := scanUser(db.QueryRow(tagQuery(c, "SELECT "+userColumns+" FROM users WHERE id = ? AND deleted_at IS NULL"+tenant), append([]any{id}, tenantArgs...)...))
+    if err != nil {
+        respondError(c, http.StatusNotFound, "User not found")
+        return
+    }
+    // The user is only returned once the read is on record.
+    if auditReads {
+        if err := auditRead(c, user.ID); err != nil {
+            respondDBError(c, err)
+            return
+        }
+    }
+    if fields != nil {
+        respondJSON(c, http.StatusOK, projectUser(user, fields))
+        return
+    }
+    respondJSON(c, http.StatusOK, user)
+}
+
+// auditRead records that the caller read user id.
+func auditRead(c *gin.Context, id UserID) error {
+    accessor, tenant := creationStamp(c)
+    _, err := db.Exec(tagQuery(c, "INSERT INTO user_read_audit (user_id, accessor, tenant_id, request_id) VALUES (?, ?, ?, ?)"), string(id), accessor, tenant, c.GetString(requestIDKey))
+    return err
+}
+
+// parseFields reads the ?fields= sparse fieldset, responding with 400 when
+// it is too long, names too many fields, or names one that doesn't exist.
+// It returns nil when the parameter is absent.
+func parseFields(c *gin.Context) ([]string, bool) {
+    v := c.Query("fields")
+    if v == "" {
+        return nil, true
+    }
+    if len(v) > fieldsMaxLength {
+        respondError(c, http.StatusBadRequest, fmt.Sprintf("fields must be at most %d characters", fieldsMaxLength))
+        return nil, false
+    }
+    raw := strings.Split(v, ",")
+    if len(raw) > fieldsMaxCount {
+        respondError(c, http.StatusBadRequest, fmt.Sprintf("at most %d fields may be requested", fieldsMaxCount))
+        return nil, false
+    }
+    fields := make([]string, 0, len(raw))
+    for _, f := range raw {
+        f = strings.TrimSpace(f)
+        if !selectableFields[f] {
+            respondError(c, http.StatusBadRequest, "Unknown field "+strconv.Quote(f))
+            return nil, false
+        }
+        fields = append(fields, f)
+    }
+    return fields, true
+}
+
+// projectUser returns the requested fields of user, keyed by their JSON
+// names. deleted_at is left out for users that aren't deleted, as in the
+// full representation.
+func projectUser(user User, fields []string) map[string]any {
+    out := make(map[string]any, len(fields))
+    for _, f := range fields {
+        switch f {
+        case "id":
+            out[f] = user.ID
+        case "name":
+            out[f] = user.Name
+        case "email":
+            out[f] = user.Email
+        case "deleted_at":
+            if user.DeletedAt != nil {
+                out[f] = user.DeletedAt
+            }
+        case "updated_at":
+            if user.UpdatedAt != nil {
+                out[f] = user.UpdatedAt
+            }
+        case "is_deleted":
+            if user.IsDeleted != nil {
+                out[f] = *user.IsDeleted
+            }
+        }
+    }
+    return out
+}
+
+// @Summary Create a user
+// @Description Create a new user. Any id in the body is ignored, or rejected with 400 when STRICT_CREATE is set.
+// @Accept json
+// @Produce json
+// @Param user body User true "User object"
+// @Param X-Captcha-Token header string false "CAPTCHA token that lifts the creation limit, when CAPTCHA_VERIFY_URL is set"
+// @Success 201 {object} User
+// @Failure 400 {object} map[string]string
+// @Failure 429 {object} map[string]string "Creation limit for this address reached (CREATE_RATE_LIMIT_RPS)"
+// @Router /users [post]
+func createUser(c *gin.Context) {
+    var user User
+    if !bindJSON(c, &user) || !checkByteLengths(c, user.Name, user.Email) {
+        return
+    }
+    if strictCreate && user.ID != "" {
+        respondError(c, http.StatusBadRequest, "id must not be provided on create")
+        return
+    }
+    if !createLimit.allow(c, 1) {
+        return
+    }
+
+    createdBy, tenant := creationStamp(c)
+    user, err := insertUser(c, db, user, createdBy, tenant)
+    if err != nil {
+        respondDBError(c, err)
+        return
+    }
+    usersCreated.Inc()
+    respondJSON(c, http.StatusCreated, user)
+}
+
+// bulkCreateRequest holds the users to create, in order.
+type bulkCreateRequest struct {
+    Users []User `json:"users" binding:"required,min=1,max=100,dive"`
+}
+
+// bulkCreated is one created user together with its position in the request.
+type bulkCreated struct {
+    Index int `json:"index"`
+    User
+}
+
+// @Summary Bulk create users
+// @Description Create up to 100 users at once. All are created or none are; the response lists them in request order with their index. Failures name the offending item as users[i] in fields. Each user counts against the creation limit.
+// @Accept json
+// @Produce json
+// @Param request body bulkCreateRequest true "Users to create"
+// @Success 201 {object} map[string][]bulkCreated
+// @Failure 400 {object} map[string]string
+// @Failure 413 {object} map[string]string
+// @Failure 429 {object} map[string]string "Creation limit for this address reached (CREATE_RATE_LIMIT_RPS)"
+// @Router /users/bulk [post]
+func bulkCreateUsers(c *gin.Context) {
+    var req bulkCreateRequest
+    if !bindJSON(c, &req) {
+        return
+    }
+    // Every item is checked before anything is written, so one response
+    // lists all the records to fix.
+    var invalid []fieldError
+    for i, user := range req.Users {
+        invalid = append(invalid, byteLengthErrors(fmt.Sprintf("users[%d].", i), user.Name, user.Email)...)
+        if strictCreate && user.ID != "" {
+            invalid = append(invalid, fieldError{Field: fmt.Sprintf("users[%d].id", i), Message: "must not be provided on create"})
+        }
+    }
+    if invalid != nil {
+        writeError(c, http.StatusUnprocessableEntity, "Validation failed", invalid)
+        return
+    }
+    if !createLimit.allow(c, len(req.Users)) {
+        return
+    }
+
+    tx, err := db.Begin()
+    if err != nil {
+        respondDBError(c, err)
+        return
+    }
+    defer tx.Rollback()
+
+    // Rows are inserted one at a time so each gets its own LastInsertId; a
+    // multi-row INSERT only reports the first ID, and the rest are only
+    // consecutive under some innodb_autoinc_lock_mode settings.
+    createdBy, tenant := creationStamp(c)
+    created := make([]bulkCreated, len(req.Users))
+    for i, user := range req.Users {
+        user, err := insertUser(c, tx, user, createdBy, tenant)
+        if err != nil {
+            if isReadOnlyError(err) {
+                respondDBError(c, err)
+                return
+            }
+            writeError(c, http.StatusInternalServerError, "Bulk create rolled back; no users were created", []fieldError{
+                {Field: fmt.Sprintf("users[%d]", i), Message: err.Error()},
+            })
+            return
+        }
+        created[i] = bulkCreated{Index: i, User: user}
+    }
+    if err := tx.Commit(); err != nil {
+        respondDBError(c, err)
+        return
+    }
+    usersCreated.Add(float64(len(created)))
+    respondJSON(c, http.StatusCreated, gin.H{"data": created})
+}
+
+// creationStamp returns the created_by and tenant_id values for users
+// created by this request.
+func creationStamp(c *gin.Context) (createdBy, tenant sql.NullString) {
+    if actor := c.GetString(actorKey); actor != "" {
+        createdBy = sql.NullString{String: actor, Valid: true}
+    }
+    if t := c.GetString(tenantKey); t != "" {
+        tenant = sql.NullString{String: t, Valid: true}
+    }
+    return createdBy, tenant
+}
+
+// execer is satisfied by *sql.DB and *sql.Tx.
+type execer interface {
+    Exec(query string, args ...any) (sql.Result, error)
+}
+
+// dbConn is satisfied by *sql.DB and *sql.Conn.
+type dbConn interface {
+    ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+    BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// connFor returns the connection a write handler should run on: the one
+// holding the user's advisory lock when there is one, so the write doesn't
+// need a second pooled connection while the lock's is held, and db
+// otherwise.
+func connFor(c *gin.Context) dbConn {
+    if conn, ok := c.Value(lockConnKey).(*sql.Conn); ok {
+        return conn
+    }
+    return db
+}
+
+// queryer is satisfied by *sql.DB and *sql.Conn.
+type queryer interface {
+    QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+    QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// beginSnapshot starts a read-only REPEATABLE READ transaction with a
+// consistent snapshot on a connection of its own, so every read through the
+// returned conn sees the database as of this call. end must be called once
+// the reads, including any open rows, are done. The transaction is driven
+// with plain statements rather than BeginTx because not every supported
+// driver accepts an isolation level there.
+func beginSnapshot(ctx context.Context) (conn *sql.Conn, end func(), err error) {
+    conn, err = db.Conn(ctx)
+    if err != nil {
+        return nil, nil, err
+    }
+    for _, stmt := range []string{
+        "SET TRANSACTION ISOLATION LEVEL REPEATABLE READ",
+        "START TRANSACTION WITH CONSISTENT SNAPSHOT, READ ONLY",
+    } {
+        if _, err := conn.ExecContext(ctx, stmt); err != nil {
+            conn.Raw(func(any) error { return driver.ErrBadConn })
+            conn.Close()
+            return nil, nil, err
+        }
+    }
+    return conn, func() {
+        // A connection still inside the transaction must not go back to
+        // the pool, so it is discarded if the rollback fails.
+        if _, err := conn.ExecContext(context.Background(), "ROLLBACK"); err != nil {
+            log.Printf("ending snapshot: %v", err)
+            conn.Raw(func(any) error { return driver.ErrBadConn })
+        }
+        conn.Close()
+    }, nil
+}
+
+// insertUser stores user and returns it with its new ID.
+func insertUser(c *gin.Context, ex execer, user User, createdBy, tenant sql.NullString) (User, error) {
+    email, emailHash, err := storedEmail(user.Email)
+    if err != nil {
+        return User{}, err
+    }
+
+    if idStrategy == idStrategyUUID {
+        user.ID = UserID(uuid.NewString())
+        _, err := ex.Exec(tagQuery(c, "INSERT INTO users (id, name, email, email_hash, created_by, tenant_id) VALUES (?, ?, ?, ?, ?, ?)"), string(user.ID), user.Name, email, emailHash, createdBy, tenant)
+        return user, err
+    }
+
+    result, err := ex.Exec(tagQuery(c, "INSERT INTO users (name, email, email_hash, created_by, tenant_id) VALUES (?, ?, ?, ?, ?)"), user.Name, email, emailHash, createdBy, tenant)
+    if err != nil {
+        return User{}, err
+    }
+    id, _ := result.LastInsertId()
+    user.ID = UserID(strconv.FormatInt(id, 10))
+    return user, nil
+}
+
+// @Summary Update a user
+// @Description Update a user by ID
+// @Accept json
+// @Produce json
+// @Param id path int true "User ID"
+// @Param user body User true "User object"
+// @Param merge query bool false "Only write fields that were sent and differ from the stored user"
+// @Success 200 {object} User
+// @Failure 409 {object} map[string]string "Another request holds the user's lock (USER_LOCKS)"
+// @Router /users/{id} [put]
+func updateUser(c *gin.Context) {
+    id, ok := parseUserID(c)
+    if !ok {
+        return
+    }
+
+    if c.Query("merge") == "true" {
+        var patch userPatch
+        if !bindJSON(c, &patch) || !checkByteLengths(c, patch.Name, patch.Email) {
+            return
+        }
+        merged, err := mergeUser(c, id, patch)
+        if err == sql.ErrNoRows {
+            respondError(c, http.StatusNotFound, "User not found")
+            return
+        }
+        if err != nil {
+            respondDBError(c, err)
+            return
+        }
+        usersUpdated.Inc()
+        respondJSON(c, http.StatusOK, merged)
+        return
+    }
+
+    var user User
+    if !bindJSON(c, &user) || !checkByteLengths(c, user.Name, user.Email) {
+        return
+    }
+
+    email, emailHash, err := storedEmail(user.Email)
+    if err != nil {
+        respondError(c, http.StatusInternalServerError, err.Error())
+        return
+    }
+
+    tenant, tenantArgs := tenantCond(c)
+    _, err = connFor(c).ExecContext(c.Request.Context(), tagQuery(c, "UPDATE users SET name = ?, email = ?, email_hash = ? WHERE id = ? AND deleted_at IS NULL"+tenant), append([]any{user.Name, email, emailHash, id}, tenantArgs...)...)
+    if err != nil {
+        respondDBError(c, err)
+        return
+    }
+
+    user.ID = id
+    usersUpdated.Inc()
+    respondJSON(c, http.StatusOK, user)
+}
+
+// @Summary Delete a user
+// @Description Soft-delete a user by ID
+// @Produce json
+// @Param id path int true "User ID"
+// @Param idempotent query bool false "Answer 204 instead of 404 when the user doesn't exist"
+// @Success 204 "No Content"
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string "Another request holds the user's lock (USER_LOCKS)"
+// @Router /users/{id} [delete]
+func deleteUser(c *gin.Context) {
+    id, ok := parseUserID(c)
+    if !ok {
+        return
+    }
+    tenant, tenantArgs := tenantCond(c)
+    result, err := connFor(c).ExecContext(c.Request.Context(), tagQuery(c, "UPDATE users SET deleted_at = NOW() WHERE id = ? AND deleted_at IS NULL"+tenant), append([]any{id}, tenantArgs...)...)
+    if err != nil {
+        respondDBError(c, err)
+        return
+    }
+    n, _ := result.RowsAffected()
+    if n == 0 && c.Query("idempotent") != "true" {
+        respondError(c, http.StatusNotFound, "User not found")
+        return
+    }
+    usersDeleted.Add(float64(n))
+    c.Status(http.StatusNoContent)
+}
+
+// @Summary Bulk update users
+// @Description Apply the same field changes to every user matching a filter (admin only)
+// @Accept json
+// @Produce json
+// @Param request body bulkUpdateRequest true "Filter and changes"
+// @Success 200 {object} map[string]int64
+// @Failure 400 {object} map[string]string
+// @Router /users/bulk-update [post]
+func bulkUpdateUsers(c *gin.Context) {
+    var req bulkUpdateRequest
+    if !bindJSON(c, &req) {
+        return
+    }
+
+    var conds []string
+    var where []any
+    if req.Filter.EmailDomain != "" {
+        if piiCipher != nil {
+            respondError(c, http.StatusBadRequest, "email_domain can't be used while emails are encrypted")
+            return
+        }
+        conds = append(conds, "email LIKE ?")
+        where = append(where, "%@"+likeEscaper.Replace(req.Filter.EmailDomain))
+    }
+    if req.Filter.CreatedBy != "" {
+        conds = append(conds, "created_by = ?")
+        where = append(where, req.Filter.CreatedBy)
+    }
+    if len(conds) == 0 {
+        respondError(c, http.StatusBadRequest, "filter must not be empty")
+        return
+    }
+    conds = append(conds, "deleted_at IS NULL")
+    if t := c.GetString(tenantKey); t != "" {
+        conds = append(conds, "tenant_id = ?")
+        where = append(where, t)
+    }
+
+    var sets []string
+    var args []any
+    for column, value := range req.Set {
+        if !bulkUpdatableColumns[column] {
+            respondError(c, http.StatusBadRequest, "field "+strconv.Quote(column)+" can't be bulk updated")
+            return
+        }
+        if value == "" || utf8.RuneCountInString(value) > 100 {
+            respondError(c, http.StatusBadRequest, "field "+strconv.Quote(column)+" must be 1 to 100 characters")
+            return
+        }
+        if column == "name" && !checkByteLengths(c, value, "") {
+            return
+        }
+        sets = append(sets, column+" = ?")
+        args = append(args, value)
+    }
+    if len(sets) == 0 {
+        respondError(c, http.StatusBadRequest, "set must not be empty")
+        return
+    }
+
+    args = append(args, where...)
+    result, err := db.Exec(tagQuery(c, "UPDATE users SET "+strings.Join(sets, ", ")+" WHERE "+strings.Join(conds, " AND ")), args...)
+    if err != nil {
+        respondDBError(c, err)
+        return
+    }
+    affected, _ := result.RowsAffected()
+    usersUpdated.Add(float64(affected))
+    respondJSON(c, http.StatusOK, gin.H{"affected": affected})
+}
+
+// mergeUser applies only the non-empty fields of patch that differ from the
+// stored row, so concurrent PUTs touching different fields don't clobber each
+// other. The row is locked between the read and the write.
+func mergeUser(c *gin.Context, id UserID, patch userPatch) (User, error) {
+    tx, err := connFor(c).BeginTx(c.Request.Context(), nil)
+    if err != nil {
+        return User{}, err
+    }
+    defer tx.Rollback()
+
+    tenant, tenantArgs := tenantCond(c)
+    current, err := scanUser(tx.QueryRow(tagQuery(c, "SELECT "+userColumns+" FROM users WHERE id = ? AND deleted_at IS NULL"+tenant+" FOR UPDATE"), append([]any{id}, tenantArgs...)...))
+    if err != nil {
+        return User{}, err
+    }
+
+    var sets []string
+    var args []any
+    if patch.Name != "" && patch.Name != current.Name {
+        sets = append(sets, "name = ?")
+        args = append(args, patch.Name)
+        current.Name = patch.Name
+    }
+    if patch.Email != "" && patch.Email != current.Email {
+        email, emailHash, err := storedEmail(patch.Email)
+        if err != nil {
+            return User{}, err
+        }
+        sets = append(sets, "email = ?", "email_hash = ?")
+        args = append(args, email, emailHash)
+        current.Email = patch.Email
+    }
+    if len(sets) == 0 {
+        return current, nil
+    }
+
+    args = append(args, id)
+    if _, err := tx.Exec(tagQuery(c, "UPDATE users SET "+strings.Join(sets, ", ")+" WHERE id = ?"), args...); err != nil {
+        return User{}, err
+    }
+    return current, tx.Commit()
+}
+
+// rowScanner is satisfied by *sql.Row and *sql.Rows.
+type rowScanner interface {
+    Scan(dest ...any) error
+}
+
+// scanUser reads a row of userColumns, decrypting the email if needed.
+func scanUser(row rowScanner) (User, error) {
+    var user User
+    if err := row.Scan(&user.ID, &user.Name, &user.Email, &user.DeletedAt, &user.UpdatedAt); err != nil {
+        return User{}, err
+    }
+    if piiCipher != nil {
+        email, err := piiCipher.decrypt(user.Email)
+        if err != nil {
+            return User{}, err
+        }
+        user.Email = email
+    }
+    return user, nil
+}
+
+// storedEmail returns the values to write to the email and email_hash
+// columns. Without encryption the email is stored as-is and the hash is NULL.
+func storedEmail(email string) (string, sql.NullString, error) {
+    if piiCipher == nil {
+        return email, sql.NullString{}, nil
+    }
+    sealed, err := piiCipher.encrypt(email)
+    if err != nil {
+        return "", sql.NullString{}, err
+    }
+    return sealed, sql.NullString{String: piiCipher.hash(email), Valid: true}, nil
+}
+
+// encryptPlaintextEmails encrypts the emails of rows stored before
+// ENCRYPT_PII was turned on, which scanUser couldn't decrypt, and returns
+// how many it converted. Those rows are the ones with a NULL email_hash. A
+// row is only rewritten while its hash is still NULL, so instances starting
+// together never encrypt an email twice.
+func encryptPlaintextEmails() (int64, error) {
+    var converted int64
+    for {
+        rows, err := db.Query("SELECT id, email FROM users WHERE email_hash IS NULL LIMIT ?", backfillBatchSize)
+        if err != nil {
+            return converted, err
+        }
+        var ids []UserID
+        var emails []string
+        for rows.Next() {
+            var id UserID
+            var email string
+            if err := rows.Scan(&id, &email); err != nil {
+                rows.Close()
+                return converted, err
+            }
+            ids = append(ids, id)
+            emails = append(emails, email)
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+            return converted, err
+        }
+
+        for i, id := range ids {
+            email, emailHash, err := storedEmail(emails[i])
+            if err != nil {
+                return converted, err
+            }
+            result, err := db.Exec("UPDATE users SET email = ?, email_hash = ? WHERE id = ? AND email_hash IS NULL", email, emailHash, id)
+            if err != nil {
+                return converted, err
+            }
+            n, _ := result.RowsAffected()
+            converted += n
+        }
+        if len(ids) < backfillBatchSize {
+            return converted, nil
+        }
+    }
+}
+
+// newEmailCipher builds an emailCipher from a 16, 24 or 32 byte AES key.
+// The hash key is derived from it so the two uses never share a key.
+func newEmailCipher(key []byte) (*emailCipher, error) {
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    aead, err := cipher.NewGCM(block)
+    if err != nil {
+        return nil, err
+    }
+    mac := hmac.New(sha256.New, key)
+    mac.Write([]byte("email-hash"))
+    return &emailCipher{aead: aead, hashKey: mac.Sum(nil)}, nil
+}
+
+// encrypt seals plain under a random nonce and base64-encodes nonce||ciphertext.
+func (e *emailCipher) encrypt(plain string) (string, error) {
+    nonce := make([]byte, e.aead.NonceSize())
+    if _, err := cryptorand.Read(nonce); err != nil {
+        return "", err
+    }
+    return base64.StdEncoding.EncodeToString(e.aead.Seal(nonce, nonce, []byte(plain), nil)), nil
+}
+
+func (e *emailCipher) decrypt(stored string) (string, error) {
+    data, err := base64.StdEncoding.DecodeString(stored)
+    if err != nil {
+        return "", err
+    }
+    if len(data) < e.aead.NonceSize() {
+        return "", errors.New("encrypted email too short")
+    }
+    nonce, sealed := data[:e.aead.NonceSize()], data[e.aead.NonceSize():]
+    plain, err := e.aead.Open(nil, nonce, sealed, nil)
+    if err != nil {
+        return "", err
+    }
+    return string(plain), nil
+}
+
+// hash returns the hex HMAC of the normalized email, used for exact lookups.
+func (e *emailCipher) hash(email string) string {
+    mac := hmac.New(sha256.New, e.hashKey)
+    mac.Write([]byte(strings.ToLower(strings.TrimSpace(email))))
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// prepareSchema brings the schema and stored data up to date before serving
+// and reports whether to go on and serve. A read-only deployment skips this
+// unless migrateOnly asks for it explicitly; migrateOnly (-migrate-only or
+// MODE=migrate) then stops once it is done.
+func prepareSchema(readOnly, migrateOnly bool) (serve bool, err error) {
+    if !readOnly || migrateOnly {
+        applied, err := migrate()
+        if err != nil {
+            return false, fmt.Errorf("migrations failed: %w", err)
+        }
+        log.Printf("applied %d migration(s)", applied)
+        if piiCipher != nil {
+            encrypted, err := encryptPlaintextEmails()
+            if err != nil {
+                return false, fmt.Errorf("encrypting stored emails: %w", err)
+            }
+            log.Printf("encrypted %d stored email(s)", encrypted)
+        }
+    }
+    return !migrateOnly, nil
+}
+
+// migrate applies the migrations newer than the highest version recorded in
+// schema_migrations and returns how many it ran.
+func migrate() (int, error) {
+    _, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version INT PRIMARY KEY, applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)")
+    if err != nil {
+        return 0, err
+    }
+    var current int
+    if err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+        return 0, err
+    }
+
+    applied := 0
+    for i, stmt := range migrations {
+        version := i + 1
+        if version <= current {
+            continue
+        }
+        if _, err := db.Exec(stmt); err != nil {
+            return applied, fmt.Errorf("migration %d: %w", version, err)
+        }
+        if _, err := db.Exec("INSERT INTO schema_migrations (version) VALUES (?)", version); err != nil {
+            return applied, err
+        }
+        applied++
+    }
+    return applied, nil
+}
+
+// loadColumnByteLimits sets nameMaxBytes and emailMaxBytes to the byte
+// capacities MySQL reports for the columns, which account for their charset:
+// a VARCHAR(100) holds 100 bytes in latin1 but 400 in utf8mb4.
+func loadColumnByteLimits() error {
+    rows, err := db.Query("SELECT COLUMN_NAME, CHARACTER_OCTET_LENGTH FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'users' AND COLUMN_NAME IN ('name', 'email')")
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var column string
+        var octets int
+        if err := rows.Scan(&column, &octets); err != nil {
+            return err
+        }
+        switch column {
+        case "name":
+            nameMaxBytes = octets
+        case "email":
+            emailMaxBytes = octets
+        }
+    }
+    return rows.Err()
+}
+
+// monitorPool samples db.Stats every cfg.Interval until ctx is done, logging
+// early signs of pool exhaustion and, at debug level, connection churn. An
+// Interval of zero or less disables it.
+func monitorPool(ctx context.Context, cfg poolHealthConfig) {
+    if cfg.Interval <= 0 {
+        return
+    }
+    ticker := time.NewTicker(cfg.Interval)
+    defer ticker.Stop()
+
+    prev := db.Stats()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+        cur := db.Stats()
+        checkPoolStats(prev, cur, cfg)
+        logPoolChurn(prev, cur)
+        prev = cur
+    }
+}
+
+// checkPoolStats logs a warning for each threshold crossed between two
+// consecutive pool samples.
+func checkPoolStats(prev, cur sql.DBStats, cfg poolHealthConfig) {
+    if waited := cur.WaitCount - prev.WaitCount; cfg.WaitCountIncrease > 0 && waited >= cfg.WaitCountIncrease {
+        slog.Warn("callers waited for a database connection",
+            "waits", waited,
+            "wait_duration", cur.WaitDuration-prev.WaitDuration,
+            "in_use", cur.InUse,
+            "max_open", cur.MaxOpenConnections)
+    }
+    if cur.MaxOpenConnections > 0 && float64(cur.InUse) >= cfg.InUseRatio*float64(cur.MaxOpenConnections) {
+        slog.Warn("database connection pool nearly exhausted",
+            "in_use", cur.InUse,
+            "max_open", cur.MaxOpenConnections)
+    }
+}
+
+// logPoolChurn logs, at debug level, the connections opened and closed
+// between two consecutive pool samples, with the reason for each close.
+// database/sql doesn't count opens, so they are inferred from the change in
+// open connections plus the closes; connections dropped as broken aren't
+// counted either, so the figure is a lower bound. Steady churn usually
+// means DB_CONN_MAX_LIFETIME or DB_CONN_MAX_IDLE_TIME is too short, or
+// DB_MAX_IDLE_CONNS too small for the load.
+func logPoolChurn(prev, cur sql.DBStats) {
+    idle := cur.MaxIdleClosed - prev.MaxIdleClosed
+    idleTime := cur.MaxIdleTimeClosed - prev.MaxIdleTimeClosed
+    lifetime := cur.MaxLifetimeClosed - prev.MaxLifetimeClosed
+    opened := int64(cur.OpenConnections-prev.OpenConnections) + idle + idleTime + lifetime
+    if opened <= 0 && idle+idleTime+lifetime == 0 {
+        return
+    }
+    slog.Debug("database connection pool churn",
+        "opened", max(opened, 0),
+        "closed_max_idle", idle,
+        "closed_idle_time", idleTime,
+        "closed_lifetime", lifetime,
+        "open", cur.OpenConnections,
+        "idle", cur.Idle)
+}
+
+// readyz reports whether the database is reachable. Failures answer 503
+// unless HealthAlways200 is set; the status field is always present.
+func readyz(c *gin.Context) {
+    err := dbAvailable()
+    if err == nil {
+        err = db.PingContext(c.Request.Context())
+    }
+    if err != nil {
+        code := http.StatusServiceUnavailable
+        if currentConfig().HealthAlways200 {
+            code = http.StatusOK
+        }
+        respondJSON(c, code, gin.H{"status": "unavailable", "error": err.Error()})
+        return
+    }
+    respondJSON(c, http.StatusOK, gin.H{"status": "ok"})
+}
+
+// limitQueryParams answers 400 to requests with more than limit query
+// parameters. Parameters are counted on the raw query string, so a flood is
+// turned away before anything parses it. Zero or less disables the check.
+func limitQueryParams(limit int) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        raw := c.Request.URL.RawQuery
+        if limit > 0 && raw != "" && strings.Count(raw, "&")+1 > limit {
+            respondError(c, http.StatusBadRequest, fmt.Sprintf("at most %d query parameters are allowed", limit))
+            return
+        }
+        c.Next()
+    }
+}
+
+// rejectWrites answers 405 to every method other than GET, HEAD and OPTIONS,
+// ahead of routing, so a READ_ONLY deployment has no reachable write path.
+func rejectWrites() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        switch c.Request.Method {
+        case http.MethodGet, http.MethodHead, http.MethodOptions:
+            c.Next()
+            return
+        }
+        c.Header("Allow", "GET, HEAD, OPTIONS")
+        respondError(c, http.StatusMethodNotAllowed, "This deployment is read-only")
+    }
+}
+
+// requireDB answers 503 instead of running handlers against a database that
+// isn't open.
+func requireDB() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if err := dbAvailable(); err != nil {
+            respondError(c, http.StatusServiceUnavailable, "Database unavailable")
+            return
+        }
+        c.Next()
+    }
+}
+
+// accessLogFormatters maps each LOG_FORMAT to the gin formatter that renders
+// its access log lines. Without LOG_FORMAT gin's own format is used.
+var accessLogFormatters = map[string]gin.LogFormatter{
+    "common":   commonLogLine,
+    "combined": combinedLogLine,
+    "json":     jsonLogLine,
+}
+
+// commonLogLine renders an Apache Common Log Format line:
+// host ident authuser [date] "request" status bytes.
+func commonLogLine(p gin.LogFormatterParams) string {
+    return commonLogFields(p) + "\n"
+}
+
+// combinedLogLine renders an Apache Combined Log Format line, which is the
+// common format followed by the quoted referer and user agent.
+func combinedLogLine(p gin.LogFormatterParams) string {
+    return fmt.Sprintf("%s %q %q\n", commonLogFields(p), orDash(p.Request.Referer()), orDash(p.Request.UserAgent()))
+}
+
+func commonLogFields(p gin.LogFormatterParams) string {
+    user, _ := p.Keys[actorKey].(string)
+    size := "-"
+    if p.BodySize > 0 {
+        size = strconv.Itoa(p.BodySize)
+    }
+    return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s",
+        p.ClientIP, orDash(user), p.TimeStamp.Format("02/Jan/2006:15:04:05 -0700"),
+        p.Method, p.Path, p.Request.Proto, p.StatusCode, size)
+}
+
+// orDash returns s, or "-" when it is empty as the log formats require.
+func orDash(s string) string {
+    if s == "" {
+        return "-"
+    }
+    return s
+}
+
+// jsonLogLine renders one JSON object per request.
+func jsonLogLine(p gin.LogFormatterParams) string {
+    user, _ := p.Keys[actorKey].(string)
+    line, _ := json.Marshal(struct {
+        Time      string  `json:"time"`
+        ClientIP  string  `json:"client_ip"`
+        User      string  `json:"user,omitempty"`
+        Method    string  `json:"method"`
+        Path      string  `json:"path"`
+        Proto     string  `json:"proto"`
+        Status    int     `json:"status"`
+        Bytes     int     `json:"bytes"`
+        LatencyMS float64 `json:"latency_ms"`
+        Referer   string  `json:"referer,omitempty"`
+        UserAgent string  `json:"user_agent,omitempty"`
+        Error     string  `json:"error,omitempty"`
+    }{
+        Time:      p.TimeStamp.Format(time.RFC3339),
+        ClientIP:  p.ClientIP,
+        User:      user,
+        Method:    p.Method,
+        Path:      p.Path,
+        Proto:     p.Request.Proto,
+        Status:    p.StatusCode,
+        Bytes:     max(p.BodySize, 0),
+        LatencyMS: float64(p.Latency.Microseconds()) / 1000,
+        Referer:   p.Request.Referer(),
+        UserAgent: p.Request.UserAgent(),
+        Error:     strings.TrimSpace(p.ErrorMessage),
+    })
+    return string(line) + "\n"
+}
+
+// errorLogger logs every 5xx response at error level and a sampled fraction
+// of 4xx responses at warn level, so misbehaving clients don't drown out
+// server failures.
+func errorLogger() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        start := time.Now()
+        c.Next()
+
+        status := c.Writer.Status()
+        attrs := []any{
+            "method", c.Request.Method,
+            "path", c.Request.URL.Path,
+            "status", status,
+            "latency", time.Since(start),
+            "client_ip", c.ClientIP(),
+            "request_id", c.GetString(requestIDKey),
+        }
+        switch {
+        case status >= 500:
+            slog.Error("server error", attrs...)
+        case status >= 400 && rand.Float64() < currentConfig().ClientErrorSampleRate:
+            slog.Warn("client error", attrs...)
+        }
+    }
+}
+
+// requestIDPattern is what an incoming X-Request-ID must look like to be
+// kept. Anything else is replaced, since the ID ends up in logs and SQL
+// comments.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestID gives every request an ID, reusing a well-formed X-Request-ID
+// from the client or generating one, and echoes it in the response.
+func requestID() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        id := c.GetHeader("X-Request-ID")
+        if !requestIDPattern.MatchString(id) {
+            id = uuid.NewString()
+        }
+        c.Set(requestIDKey, id)
+        c.Header("X-Request-ID", id)
+        c.Next()
+    }
+}
+
+// tagQuery prefixes query with a comment naming the request it runs for, so
+// statements in MySQL's slow query log and processlist can be matched to
+// application logs. It is a no-op unless DB_QUERY_COMMENTS is set.
+func tagQuery(c *gin.Context, query string) string {
+    id := c.GetString(requestIDKey)
+    if !queryComments || id == "" {
+        return query
+    }
+    return "/* request_id=" + id + " */ " + query
+}
+
+// apiKeyAuth authenticates requests by their X-API-Key header against keys,
+// storing the key's name and scopes in the context. With no keys configured
+// authentication is disabled and every request passes through.
+func apiKeyAuth(keys []apiKey) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if len(keys) == 0 {
+            c.Next()
+            return
+        }
+        presented := []byte(c.GetHeader("X-API-Key"))
+        for _, k := range keys {
+            if subtle.ConstantTimeCompare(presented, []byte(k.Key)) == 1 {
+                c.Set(actorKey, k.Name)
+                c.Set(scopesKey, k.Scopes)
+                if k.Tenant != "" {
+                    c.Set(tenantKey, k.Tenant)
+                }
+                c.Next()
+                return
+            }
+        }
+        respondError(c, http.StatusUnauthorized, "Invalid or missing API key")
+    }
+}
+
+// resolveTenant requires every request to belong to a tenant when
+// MULTI_TENANT is on. A key pinned to a tenant decides it. The X-Tenant-ID
+// header, which any caller can set, only decides it for other requests when
+// trustHeader is set, as behind a gateway that sets the header itself;
+// otherwise they are refused.
+func resolveTenant(trustHeader bool) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        header := c.GetHeader("X-Tenant-ID")
+        if pinned := c.GetString(tenantKey); pinned != "" {
+            if header != "" && header != pinned {
+                respondError(c, http.StatusForbidden, "API key is not valid for tenant "+strconv.Quote(header))
+                return
+            }
+            c.Next()
+            return
+        }
+        if !trustHeader {
+            respondError(c, http.StatusForbidden, "API key is not pinned to a tenant")
+            return
+        }
+        if header == "" || len(header) > 64 {
+            respondError(c, http.StatusBadRequest, "X-Tenant-ID header must be 1 to 64 characters")
+            return
+        }
+        c.Set(tenantKey, header)
+        c.Next()
+    }
+}
+
+// checkTenantPinning refuses a MULTI_TENANT configuration in which a caller
+// could pick its own tenant: unless the X-Tenant-ID header is trusted,
+// API_KEYS must be set and every key pinned to a tenant.
+func checkTenantPinning(keys []apiKey, trustHeader bool) error {
+    if trustHeader {
+        return nil
+    }
+    if len(keys) == 0 {
+        return errors.New("MULTI_TENANT needs API_KEYS pinned to tenants, or TRUST_TENANT_HEADER")
+    }
+    for _, k := range keys {
+        if k.Tenant == "" {
+            return fmt.Errorf("MULTI_TENANT: API key %q is not pinned to a tenant; pin it or set TRUST_TENANT_HEADER", k.Name)
+        }
+    }
+    return nil
+}
+
+// tenantCond returns a condition, to append to a WHERE clause, and its
+// argument restricting a query to the caller's tenant. Both are empty when
+// the request has no tenant.
+func tenantCond(c *gin.Context) (string, []any) {
+    if t := c.GetString(tenantKey); t != "" {
+        return " AND tenant_id = ?", []any{t}
+    }
+    return "", nil
+}
+
+// requireScope rejects with 403 callers whose API key lacks scope. Requests
+// are let through when authentication is disabled.
+func requireScope(scope string) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if !hasScope(c, scope) {
+            respondError(c, http.StatusForbidden, "API key lacks scope "+scope)
+            return
+        }
+        c.Next()
+    }
+}
+
+// hasScope reports whether the caller's API key grants scope. Every scope is
+// granted when authentication is disabled.
+func hasScope(c *gin.Context, scope string) bool {
+    if _, authenticated := c.Get(scopesKey); !authenticated {
+        return true
+    }
+    for _, s := range c.GetStringSlice(scopesKey) {
+        if s == scope {
+            return true
+        }
+    }
+    return false
+}
+
+// chaos injects latency and 503 errors into a configured fraction of
+// requests so client retries, timeouts and circuit breakers can be
+// exercised against a real server.
+func chaos(cfg chaosConfig) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if len(cfg.Routes) > 0 && !cfg.Routes[c.FullPath()] {
+            c.Next()
+            return
+        }
+        if rand.Float64() < cfg.LatencyRate {
+            select {
+            case <-time.After(cfg.Latency):
+            case <-c.Request.Context().Done():
+                c.Abort()
+                return
+            }
+        }
+        if rand.Float64() < cfg.ErrorRate {
+            respondError(c, http.StatusServiceUnavailable, "Injected fault")
+            return
+        }
+        c.Next()
+    }
+}
+
+// loadChaosConfig reads the CHAOS_* variables.
+func loadChaosConfig() chaosConfig {
+    return chaosConfig{
+        Routes:      routeSet(os.Getenv("CHAOS_ROUTES")),
+        ErrorRate:   envFloat("CHAOS_ERROR_RATE", 0),
+        LatencyRate: envFloat("CHAOS_LATENCY_RATE", 0),
+        Latency:     envDuration("CHAOS_LATENCY", time.Second),
+    }
+}
+
+// routeSet parses a comma-separated list of route patterns, as reported by
+// gin's FullPath, e.g. "/api/v1/users,/api/v1/users/:id".
+func routeSet(list string) map[string]bool {
+    routes := map[string]bool{}
+    for _, route := range strings.Split(list, ",") {
+        if route = strings.TrimSpace(route); route != "" {
+            routes[route] = true
+        }
+    }
+    return routes
+}
+
+// checkDebugOnly refuses the named development setting when gin runs in
+// release mode, so it can't be left on in production.
+func checkDebugOnly(setting string) error {
+    if gin.Mode() == gin.ReleaseMode {
+        return fmt.Errorf("%s cannot be used in release mode", setting)
+    }
+    return nil
+}
+
+// simulateLatency holds every request, or only those on routes when it is
+// non-empty, for delay before handling it, so frontends can be tried
+// against a slow backend. A client that gives up ends the wait.
+func simulateLatency(delay time.Duration, routes map[string]bool) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if len(routes) > 0 && !routes[c.FullPath()] {
+            c.Next()
+            return
+        }
+        timer := time.NewTimer(delay)
+        defer timer.Stop()
+        select {
+        case <-timer.C:
+        case <-c.Request.Context().Done():
+            c.Abort()
+            return
+        }
+        c.Next()
+    }
+}
+
+// securityHeaderValues holds the values set by the securityHeaders middleware.
+// An empty value leaves that header out.
+type securityHeaderValues struct {
+    ContentTypeOptions    string
+    FrameOptions          string
+    ContentSecurityPolicy string
+    StrictTransport       string
+}
+
+// loadSecurityHeaders reads the security header values from the
+// environment. The default CSP allows the inline script and styles the
+// Swagger UI needs.
+func loadSecurityHeaders() securityHeaderValues {
+    return securityHeaderValues{
+        ContentTypeOptions:    envString("X_CONTENT_TYPE_OPTIONS", "nosniff"),
+        FrameOptions:          envString("X_FRAME_OPTIONS", "DENY"),
+        ContentSecurityPolicy: envString("CONTENT_SECURITY_POLICY", "default-src 'self'; script-src 'self' 'unsafe-inline'; style-src 'self' 'unsafe-inline'; img-src 'self' data:"),
+        StrictTransport:       envString("STRICT_TRANSPORT_SECURITY", "max-age=63072000; includeSubDomains"),
+    }
+}
+
+// securityHeaders sets the configured security headers on every response.
+// Strict-Transport-Security is only sent over HTTPS, where browsers honor it.
+func securityHeaders(v securityHeaderValues) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        h := c.Writer.Header()
+        if v.ContentTypeOptions != "" {
+            h.Set("X-Content-Type-Options", v.ContentTypeOptions)
+        }
+        if v.FrameOptions != "" {
+            h.Set("X-Frame-Options", v.FrameOptions)
+        }
+        if v.ContentSecurityPolicy != "" {
+            h.Set("Content-Security-Policy", v.ContentSecurityPolicy)
+        }
+        if v.StrictTransport != "" && requestScheme(c) == "https" {
+            h.Set("Strict-Transport-Security", v.StrictTransport)
+        }
+        c.Next()
+    }
+}
+
+// rateLimiter keeps a token bucket per caller: each may burst up to burst
+// requests, refilled at rate tokens per second.
+type rateLimiter struct {
+    rate  float64
+    burst float64
+
+    mu        sync.Mutex
+    buckets   map[string]*tokenBucket
+    lastSweep time.Time
+}
+
+type tokenBucket struct {
+    tokens  float64
+    updated time.Time
+}
+
+// rateLimitStatus describes a caller's bucket. Reset is the Unix time at
+// which the bucket will be full again.
+type rateLimitStatus struct {
+    Limit      int           `json:"limit"`
+    Remaining  int           `json:"remaining"`
+    Reset      int64         `json:"reset"`
+    retryAfter time.Duration // until the next token, when none remain
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+    return &rateLimiter{
+        rate:      rate,
+        burst:     float64(max(burst, 1)),
+        buckets:   make(map[string]*tokenBucket),
+        lastSweep: time.Now(),
+    }
+}
+
+// allow takes a token from key's bucket if one is available.
+func (l *rateLimiter) allow(key string) (rateLimitStatus, bool) {
+    return l.allowN(key, 1)
+}
+
+// allowN takes n tokens from key's bucket if that many are available, and
+// none otherwise. A bucket never holds more than burst tokens, so n above
+// burst is never allowed.
+func (l *rateLimiter) allowN(key string, n int) (rateLimitStatus, bool) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    now := time.Now()
+    l.sweep(now)
+    b, ok := l.buckets[key]
+    if !ok {
+        b = &tokenBucket{tokens: l.burst, updated: now}
+        l.buckets[key] = b
+    }
+    l.refill(b, now)
+    allowed := b.tokens >= float64(n)
+    if allowed {
+        b.tokens -= float64(n)
+    }
+    st := l.status(b.tokens, now)
+    if !allowed {
+        st.retryAfter = time.Duration((math.Min(float64(n), l.burst) - b.tokens) / l.rate * float64(time.Second))
+    }
+    return st, allowed
+}
+
+// peek reports key's bucket without taking a token.
+func (l *rateLimiter) peek(key string) rateLimitStatus {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    now := time.Now()
+    b, ok := l.buckets[key]
+    if !ok {
+        return l.status(l.burst, now)
+    }
+    l.refill(b, now)
+    return l.status(b.tokens, now)
+}
+
+// refill credits b with the tokens earned since it was last updated.
+func (l *rateLimiter) refill(b *tokenBucket, now time.Time) {
+    b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+    b.updated = now
+}
+
+func (l *rateLimiter) status(tokens float64, now time.Time) rateLimitStatus {
+    untilFull := time.Duration((l.burst - tokens) / l.rate * float64(time.Second))
+    st := rateLimitStatus{
+        Limit:     int(l.burst),
+        Remaining: int(tokens),
+        Reset:     now.Add(untilFull).Unix(),
+    }
+    if tokens < 1 {
+        st.retryAfter = time.Duration((1 - tokens) / l.rate * float64(time.Second))
+    }
+    return st
+}
+
+// sweep forgets buckets that have refilled completely, at most once a
+// minute, so memory is bounded by the number of recently active callers.
+func (l *rateLimiter) sweep(now time.Time) {
+    if now.Sub(l.lastSweep) < time.Minute {
+        return
+    }
+    l.lastSweep = now
+    for key, b := range l.buckets {
+        if b.tokens+now.Sub(b.updated).Seconds()*l.rate >= l.burst {
+            delete(l.buckets, key)
+        }
+    }
+}
+
+// rateLimitKey identifies the caller: the API key name when authenticated,
+// otherwise the client IP.
+func rateLimitKey(c *gin.Context) string {
+    if actor := c.GetString(actorKey); actor != "" {
+        return "key:" + actor
+    }
+    return "ip:" + c.ClientIP()
+}
+
+func setRateLimitHeaders(c *gin.Context, st rateLimitStatus) {
+    c.Header("X-RateLimit-Limit", strconv.Itoa(st.Limit))
+    c.Header("X-RateLimit-Remaining", strconv.Itoa(st.Remaining))
+    c.Header("X-RateLimit-Reset", strconv.FormatInt(st.Reset, 10))
+}
+
+// rateLimit rejects requests with 429 once the caller's bucket is empty.
+func rateLimit(l *rateLimiter) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        st, ok := l.allow(rateLimitKey(c))
+        setRateLimitHeaders(c, st)
+        if !ok {
+            c.Header("Retry-After", strconv.Itoa(int(math.Ceil(st.retryAfter.Seconds()))))
+            respondError(c, http.StatusTooManyRequests, "Rate limit exceeded")
+            return
+        }
+        c.Next()
+    }
+}
+
+// humanVerifier checks a CAPTCHA token sent by a client that has exceeded
+// the creation limit. It is the extension point for CAPTCHA providers.
+type humanVerifier interface {
+    Verify(ctx context.Context, token, remoteIP string) error
+}
+
+// siteverify is a humanVerifier for providers with a reCAPTCHA-style
+// siteverify endpoint (reCAPTCHA, hCaptcha, Turnstile): the secret and
+// token are POSTed as a form and the JSON answer says whether it passed.
+type siteverify struct {
+    url    string
+    secret string
+    client *http.Client
+}
+
+func (s siteverify) Verify(ctx context.Context, token, remoteIP string) error {
+    form := url.Values{"secret": {s.secret}, "response": {token}, "remoteip": {remoteIP}}
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, strings.NewReader(form.Encode()))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    resp, err := s.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    var result struct {
+        Success bool `json:"success"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+        return err
+    }
+    if !result.Success {
+        return errors.New("captcha verification failed")
+    }
+    return nil
+}
+
+// creationLimiter is a creation-specific rate limit per client IP, on top
+// of the general limiter. Each created user costs a token, so a bulk create
+// is charged for all of its users.
+type creationLimiter struct {
+    limiter  *rateLimiter
+    verifier humanVerifier
+}
+
+// allow charges n creations to the client's IP. Once its bucket can't cover
+// them the request fails with 429 and allow returns false, unless verifier
+// is set and the request carries an X-Captcha-Token it accepts. The general
+// X-RateLimit-* headers are left to the general limiter. A nil limiter
+// allows everything.
+func (cl *creationLimiter) allow(c *gin.Context, n int) bool {
+    if cl == nil {
+        return true
+    }
+    st, ok := cl.limiter.allowN("ip:"+c.ClientIP(), n)
+    if ok {
+        return true
+    }
+    if cl.verifier != nil {
+        c.Header("X-Captcha-Required", "true")
+        if token := c.GetHeader("X-Captcha-Token"); token != "" {
+            err := cl.verifier.Verify(c.Request.Context(), token, c.ClientIP())
+            if err == nil {
+                return true
+            }
+            slog.Info("creation captcha rejected", "client_ip", c.ClientIP(), "error", err)
+        }
+    }
+    c.Header("Retry-After", strconv.Itoa(int(math.Ceil(st.retryAfter.Seconds()))))
+    respondError(c, http.StatusTooManyRequests, "Too many users created from this address")
+    return false
+}
+
+// @Summary Rate limit status
+// @Description Report the caller's rate limit, remaining requests and reset time without consuming a request
+// @Produce json
+// @Success 200 {object} rateLimitStatus
+// @Router /ratelimit [get]
+func rateLimitStatusHandler(l *rateLimiter) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        st := l.peek(rateLimitKey(c))
+        setRateLimitHeaders(c, st)
+        respondJSON(c, http.StatusOK, st)
+    }
+}
+
+// serverFeatures describes how this deployment is configured, for clients
+// that adapt to it.
+type serverFeatures struct {
+    ReadOnly        bool     `json:"read_only"`
+    MultiTenant     bool     `json:"multi_tenant"`
+    IDStrategy      string   `json:"id_strategy"`
+    EncryptedEmails bool     `json:"encrypted_emails"`
+    StrictCreate    bool     `json:"strict_create"`
+    Gzip            bool     `json:"gzip"`
+    ExportFormats   []string `json:"export_formats"`
+    MaxListLimit    int      `json:"max_list_limit"`
+}
+
+// apiMeta is the body of GET /meta. RateLimit is omitted when rate limiting
+// is off.
+type apiMeta struct {
+    RateLimit *rateLimitStatus `json:"rate_limit,omitempty"`
+    Scopes    []string         `json:"scopes"`
+    Features  serverFeatures   `json:"features"`
+}
+
+// knownScopes are the scopes an API key may be granted.
+var knownScopes = []string{"users:read", "users:write", "users:admin"}
+
+// @Summary API metadata
+// @Description Report the caller's rate limit status and granted scopes together with the server's features, without consuming a request
+// @Produce json
+// @Success 200 {object} apiMeta
+// @Router /meta [get]
+func metaHandler(l *rateLimiter, features serverFeatures) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        meta := apiMeta{Scopes: []string{}, Features: features}
+        if l != nil {
+            st := l.peek(rateLimitKey(c))
+            meta.RateLimit = &st
+        }
+        for _, scope := range knownScopes {
+            if hasScope(c, scope) {
+                meta.Scopes = append(meta.Scopes, scope)
+            }
+        }
+        respondJSON(c, http.StatusOK, meta)
+    }
+}
+
+// schemaVersion is bumped whenever a change to the models served by
+// /schema would break generated clients.
+const schemaVersion = 1
+
+// apiSchema returns the JSON Schema document for the API's models. It
+// depends on ID_STRATEGY and JSON_NAMING, so it is built once they are set.
+func apiSchema() map[string]any {
+    return map[string]any{
+        "$schema": "https://json-schema.org/draft/2020-12/schema",
+        "version": schemaVersion,
+        "$defs": map[string]any{
+            "User": structSchema(reflect.TypeOf(User{})),
+        },
+    }
+}
+
+// structSchema derives an object schema from t's json and binding tags.
+// Fields without binding rules are set by the server and marked readOnly.
+func structSchema(t reflect.Type) map[string]any {
+    props := map[string]any{}
+    var required []string
+    for i := 0; i < t.NumField(); i++ {
+        f := t.Field(i)
+        name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+        if name == "" || name == "-" {
+            continue
+        }
+        if camelJSON {
+            name = snakeToCamel(name)
+        }
+        prop := typeSchema(f.Type)
+        rules := f.Tag.Get("binding")
+        if rules == "" {
+            prop["readOnly"] = true
+        }
+        for _, rule := range strings.Split(rules, ",") {
+            key, value, _ := strings.Cut(rule, "=")
+            switch key {
+            case "required":
+                required = append(required, name)
+            case "email":
+                prop["format"] = "email"
+            case "max":
+                if n, err := strconv.Atoi(value); err == nil {
+                    prop["maxLength"] = n
+                }
+            case "min":
+                if n, err := strconv.Atoi(value); err == nil {
+                    prop["minLength"] = n
+                }
+            }
+        }
+        props[name] = prop
+    }
+    schema := map[string]any{"type": "object", "properties": props}
+    if required != nil {
+        schema["required"] = required
+    }
+    return schema
+}
+
+// typeSchema maps a field's Go type to its JSON Schema type.
+func typeSchema(t reflect.Type) map[string]any {
+    if t.Kind() == reflect.Pointer {
+        t = t.Elem()
+    }
+    switch t {
+    case reflect.TypeOf(UserID("")):
+        if idStrategy == idStrategyUUID {
+            return map[string]any{"type": "string", "format": "uuid"}
+        }
+        return map[string]any{"type": "integer"}
+    case reflect.TypeOf(time.Time{}):
+        return map[string]any{"type": "string", "format": "date-time"}
+    }
+    switch t.Kind() {
+    case reflect.String:
+        return map[string]any{"type": "string"}
+    case reflect.Bool:
+        return map[string]any{"type": "boolean"}
+    case reflect.Int, reflect.Int32, reflect.Int64:
+        return map[string]any{"type": "integer"}
+    }
+    return map[string]any{}
+}
+
+// @Summary API schema
+// @Description JSON Schema for the User model, derived from the same struct tags that validate requests. version changes when the schema changes incompatibly.
+// @Produce json
+// @Success 200 {object} map[string]any
+// @Router /schema [get]
+func schemaHandler(schema map[string]any) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        respondJSON(c, http.StatusOK, schema)
+    }
+}
+
+// gzipResponses compresses response bodies for clients whose Accept-Encoding
+// prefers gzip. Each request is negotiated on its own, so a client that asks
+// for identity always gets an uncompressed body. Range requests are never
+// compressed, since their byte ranges are offsets into the uncompressed
+// body.
+func gzipResponses() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        c.Writer.Header().Add("Vary", "Accept-Encoding")
+        if c.Request.Method == http.MethodHead || c.GetHeader("Range") != "" || !acceptsGzip(c.GetHeader("Accept-Encoding")) {
+            c.Next()
+            return
+        }
+        w := &gzipWriter{ResponseWriter: c.Writer}
+        c.Writer = w
+        defer w.Close()
+        c.Next()
+    }
+}
+
+// maxNegotiationEntries caps how many comma-separated entries of an Accept
+// or Accept-Encoding header are considered; the rest are ignored.
+const maxNegotiationEntries = 20
+
+// negotiationEntries splits a content negotiation header into at most
+// maxNegotiationEntries entries.
+func negotiationEntries(header string) []string {
+    parts := strings.SplitN(header, ",", maxNegotiationEntries+1)
+    if len(parts) > maxNegotiationEntries {
+        parts = parts[:maxNegotiationEntries]
+    }
+    return parts
+}
+
+// parseQValue returns the q parameter among the ;-separated params of a
+// header entry, 1 when there is none. ok is false when the q-value is
+// malformed or outside 0-1, in which case the entry should be ignored.
+func parseQValue(params string) (q float64, ok bool) {
+    q = 1
+    for _, param := range strings.Split(params, ";") {
+        k, v, found := strings.Cut(strings.TrimSpace(param), "=")
+        if !found || !strings.EqualFold(strings.TrimSpace(k), "q") {
+            continue
+        }
+        parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+        if err != nil || math.IsNaN(parsed) || parsed < 0 || parsed > 1 {
+            return 0, false
+        }
+        q = parsed
+    }
+    return q, true
+}
+
+// acceptsGzip reports whether gzip is acceptable and at least as preferred
+// as identity in an Accept-Encoding header. Entries with malformed q-values
+// are skipped, so a garbage header falls back to identity.
+func acceptsGzip(header string) bool {
+    gzipQ, identityQ, anyQ := -1.0, -1.0, -1.0
+    for _, part := range negotiationEntries(header) {
+        coding, params, _ := strings.Cut(part, ";")
+        q, ok := parseQValue(params)
+        if !ok {
+            continue
+        }
+        switch strings.ToLower(strings.TrimSpace(coding)) {
+        case "gzip":
+            gzipQ = q
+        case "identity":
+            identityQ = q
+        case "*":
+            anyQ = q
+        }
+    }
+    if gzipQ < 0 {
+        gzipQ = anyQ
+    }
+    return gzipQ > 0 && gzipQ >= identityQ
+}
+
+// gzipWriter compresses everything written through it. The encoder is only
+// started on the first write so empty responses such as 204 stay empty.
+type gzipWriter struct {
+    gin.ResponseWriter
+    gz *gzip.Writer
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+    if w.gz == nil {
+        w.Header().Set("Content-Encoding", "gzip")
+        w.Header().Del("Content-Length")
+        w.gz = gzip.NewWriter(w.ResponseWriter)
+    }
+    return w.gz.Write(b)
+}
+
+func (w *gzipWriter) WriteString(s string) (int, error) {
+    return w.Write([]byte(s))
+}
+
+func (w *gzipWriter) Flush() {
+    if w.gz != nil {
+        w.gz.Flush()
+    }
+    w.ResponseWriter.Flush()
+}
+
+// Unwrap lets http.ResponseController reach the connection underneath.
+func (w *gzipWriter) Unwrap() http.ResponseWriter {
+    return w.ResponseWriter
+}
+
+func (w *gzipWriter) Close() error {
+    if w.gz == nil {
+        return nil
+    }
+    return w.gz.Close()
+}
+
+// deprecationWarnings adds an RFC 7234 Warning header for every configured
+// field deprecation so clients notice before the field is removed.
+func deprecationWarnings() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        for _, d := range currentConfig().Deprecations {
+            c.Writer.Header().Add("Warning", fmt.Sprintf(`299 - "Deprecated field %s: %s"`, d.Field, d.Message))
+        }
+        c.Next()
+    }
+}
+
+// limitConcurrent lets at most limit requests through at once, so long-lived
+// streams can't pile up without bound. A slot is released when its request
+// finishes, including when the client disconnects. Zero or less disables the
+// limit.
+//
+// With queue set, requests over the limit wait for a slot until their client
+// gives up. Otherwise they fail fast with 503 and message, X-Queue-Position
+// (where they would have queued) and a Retry-After estimated from how long
+// requests have recently held a slot. A rejected request keeps its place in
+// the queue until its Retry-After has passed, so clients turned away in a
+// burst are told successive positions.
+func limitConcurrent(limit int, queue bool, message string) gin.HandlerFunc {
+    if limit <= 0 {
+        return func(c *gin.Context) { c.Next() }
+    }
+    slots := make(chan struct{}, limit)
+    var waiting atomic.Int64
+    var avgHold atomic.Int64 // moving average of slot hold time, in ns
+    return func(c *gin.Context) {
+        select {
+        case slots <- struct{}{}:
+        default:
+            if !queue {
+                position := waiting.Add(1)
+                wait := time.Duration(avgHold.Load()) * time.Duration(position) / time.Duration(limit)
+                retryAfter := max(1, int(math.Ceil(wait.Seconds())))
+                time.AfterFunc(time.Duration(retryAfter)*time.Second, func() { waiting.Add(-1) })
+                c.Header("X-Queue-Position", strconv.FormatInt(position, 10))
+                c.Header("Retry-After", strconv.Itoa(retryAfter))
+                respondError(c, http.StatusServiceUnavailable, message)
+                return
+            }
+            waiting.Add(1)
+            select {
+            case slots <- struct{}{}:
+                waiting.Add(-1)
+            case <-c.Request.Context().Done():
+                waiting.Add(-1)
+                c.Abort()
+                return
+            }
+        }
+        start := time.Now()
+        defer func() {
+            held := int64(time.Since(start))
+            avgHold.Store(avgHold.Load() - avgHold.Load()/8 + held/8)
+            <-slots
+        }()
+        c.Next()
+    }
+}
+
+// envLimitMode reads a concurrency limit's mode from the named variable:
+// "block" queues requests over the limit and "fail", the default, rejects
+// them.
+func envLimitMode(key string) (queue bool) {
+    switch v := os.Getenv(key); v {
+    case "", "fail":
+        return false
+    case "block":
+        return true
+    default:
+        log.Fatalf("invalid %s %q", key, v)
+        return false
+    }
+}
+
+// tenantSlots is one tenant's query budget. refs counts the requests holding
+// or waiting for a slot, so idle tenants can be forgotten.
+type tenantSlots struct {
+    ch   chan struct{}
+    refs int
+}
+
+// limitTenantQueries lets each tenant have at most limit requests working
+// against the database at once, so one busy tenant can't take every pooled
+// connection. A request over its tenant's budget waits up to wait for a
+// slot and then fails with 503; other tenants are unaffected. Requests
+// without a tenant, and zero or less for limit, are not limited.
+func limitTenantQueries(limit int, wait time.Duration) gin.HandlerFunc {
+    if limit <= 0 {
+        return func(c *gin.Context) { c.Next() }
+    }
+    var mu sync.Mutex
+    budgets := map[string]*tenantSlots{}
+    return func(c *gin.Context) {
+        tenant := c.GetString(tenantKey)
+        if tenant == "" {
+            c.Next()
+            return
+        }
+        mu.Lock()
+        s := budgets[tenant]
+        if s == nil {
+            s = &tenantSlots{ch: make(chan struct{}, limit)}
+            budgets[tenant] = s
+        }
+        s.refs++
+        mu.Unlock()
+        defer func() {
+            mu.Lock()
+            if s.refs--; s.refs == 0 {
+                delete(budgets, tenant)
+            }
+            mu.Unlock()
+        }()
+
+        timer := time.NewTimer(wait)
+        defer timer.Stop()
+        select {
+        case s.ch <- struct{}{}:
+        case <-timer.C:
+            c.Header("Retry-After", "1")
+            respondError(c, http.StatusServiceUnavailable, "Tenant query budget exhausted")
+            return
+        case <-c.Request.Context().Done():
+            c.Abort()
+            return
+        }
+        defer func() { <-s.ch }()
+        c.Next()
+    }
+}
+
+// errUserLocked means another request held a user's advisory lock for the
+// whole timeout.
+var errUserLocked = errors.New("user is locked by another request")
+
+// lockUser takes the MySQL advisory lock user:<id> on a connection of its
+// own, waiting up to timeout for it. The critical section's statements
+// should run on the returned conn; release frees the lock and the conn and
+// must be called once the critical section is done.
+func lockUser(ctx context.Context, id UserID, timeout time.Duration) (conn *sql.Conn, release func(), err error) {
+    conn, err = db.Conn(ctx)
+    if err != nil {
+        return nil, nil, err
+    }
+    name := "user:" + string(id)
+    var got sql.NullInt64
+    if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", name, timeout.Seconds()).Scan(&got); err != nil {
+        conn.Close()
+        return nil, nil, err
+    }
+    if got.Int64 != 1 {
+        conn.Close()
+        return nil, nil, errUserLocked
+    }
+    return conn, func() {
+        // The request may have been canceled by now, but the lock still has
+        // to go. If it can't be released, the connection is discarded
+        // rather than returned to the pool, and MySQL drops the lock when
+        // it closes.
+        if _, err := conn.ExecContext(context.Background(), "DO RELEASE_LOCK(?)", name); err != nil {
+            log.Printf("releasing %s: %v", name, err)
+            conn.Raw(func(any) error { return driver.ErrBadConn })
+        }
+        conn.Close()
+    }, nil
+}
+
+// serializeUserWrites holds the user's advisory lock for the rest of the
+// request, so concurrent writes to one user run one after another. The
+// handler finds the lock's connection with connFor, so a locked write
+// takes one pooled connection, not two. A request that can't get the lock
+// within timeout fails with 409; one with an invalid ID is passed on for
+// the handler to reject.
+func serializeUserWrites(timeout time.Duration) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        id, ok := validUserID(c.Param("id"))
+        if !ok {
+            c.Next()
+            return
+        }
+        conn, release, err := lockUser(c.Request.Context(), id, timeout)
+        if err == errUserLocked {
+            c.Header("Retry-After", "1")
+            respondError(c, http.StatusConflict, "User is being modified by another request")
+            return
+        }
+        if err != nil {
+            respondDBError(c, err)
+            return
+        }
+        defer release()
+        c.Set(lockConnKey, conn)
+        c.Next()
+    }
+}
+
+// limitBody answers 413 to requests whose body is larger than n bytes. A
+// declared Content-Length is rejected up front; otherwise the body is cut
+// off at n bytes while it is decoded, and bindJSON reports the 413.
+func limitBody(n int64) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if c.Request.ContentLength > n {
+            respondError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body must be at most %d bytes", n))
+            return
+        }
+        if c.Request.Body != nil {
+            c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, n)
+        }
+        c.Next()
+    }
+}
+
+// cacheControl sets the Cache-Control policy (e.g. "private, max-age=30")
+// selected from the active config on the response. An empty policy leaves
+// the header unset.
+func cacheControl(policyFor func(cfg *runtimeConfig) string) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if policy := policyFor(currentConfig()); policy != "" {
+            c.Header("Cache-Control", policy)
+        }
+        c.Next()
+    }
+}
+
+// loadRuntimeConfig reads the reloadable settings from the environment.
+func loadRuntimeConfig() *runtimeConfig {
+    cfg := &runtimeConfig{
+        HealthAlways200:       envBool("HEALTH_ALWAYS_200"),
+        SearchMaxLength:       envInt("SEARCH_MAX_LENGTH", 100),
+        ClientErrorSampleRate: envFloat("LOG_4XX_SAMPLE_RATE", 0.1),
+        CacheControlList:      os.Getenv("CACHE_CONTROL_LIST"),
+        CacheControlItem:      os.Getenv("CACHE_CONTROL_ITEM"),
+    }
+    if v := os.Getenv("LOG_LEVEL"); v != "" {
+        if err := cfg.LogLevel.UnmarshalText([]byte(v)); err != nil {
+            slog.Warn("ignoring invalid LOG_LEVEL", "value", v)
+        }
+    }
+    logLevel.Set(cfg.LogLevel)
+
+    if v := os.Getenv("DEPRECATED_FIELDS"); v != "" {
+        var fields map[string]string
+        if err := json.Unmarshal([]byte(v), &fields); err != nil {
+            slog.Warn("ignoring invalid DEPRECATED_FIELDS", "error", err)
+        }
+        for field, message := range fields {
+            cfg.Deprecations = append(cfg.Deprecations, deprecation{Field: field, Message: message})
+        }
+        sort.Slice(cfg.Deprecations, func(i, j int) bool { return cfg.Deprecations[i].Field < cfg.Deprecations[j].Field })
+    }
+    return cfg
+}
+
+// applyConfigFile copies KEY=VALUE lines from path into the environment.
+// When reloading, only reloadableKeys are applied and the rest are logged.
+func applyConfigFile(path string, reloading bool) error {
+    f, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        key, value, ok := strings.Cut(line, "=")
+        if !ok {
+            continue
+        }
+        key = strings.TrimSpace(key)
+        if reloading && !reloadableKeys[key] {
+            if os.Getenv(key) != strings.TrimSpace(value) {
+                slog.Info("ignoring change to non-reloadable setting until restart", "key", key)
+            }
+            continue
+        }
+        os.Setenv(key, strings.TrimSpace(value))
+    }
+    return scanner.Err()
+}
+
+// watchReload swaps in a freshly loaded runtimeConfig on every SIGHUP.
+func watchReload(configFile string) {
+    hup := make(chan os.Signal, 1)
+    signal.Notify(hup, syscall.SIGHUP)
+    for range hup {
+        if configFile != "" {
+            if err := applyConfigFile(configFile, true); err != nil {
+                slog.Error("config reload failed", "error", err)
+                continue
+            }
+        }
+        activeConfig.Store(loadRuntimeConfig())
+        slog.Info("configuration reloaded")
+    }
+}
+
+// envFloat parses the named environment variable as a float, falling back to
+// def when it is unset or malformed.
+func envFloat(key string, def float64) float64 {
+    v, err := strconv.ParseFloat(os.Getenv(key), 64)
+    if err != nil {
+        return def
+    }
+    return v
+}
+
+// envDuration parses the named environment variable as a time.Duration,
+// falling back to def when it is unset or malformed.
+func envDuration(key string, def time.Duration) time.Duration {
+    v, err := time.ParseDuration(os.Getenv(key))
+    if err != nil {
+        return def
+    }
+    return v
+}
+
+// envInt parses the named environment variable as an int, falling back to
+// def when it is unset or malformed.
+func envInt(key string, def int) int {
+    v, err := strconv.Atoi(os.Getenv(key))
+    if err != nil {
+        return def
+    }
+    return v
+}
+
+// envString returns the named environment variable, or def when it is
+// unset. A variable set to the empty string is returned as is.
+func envString(key, def string) string {
+    if v, ok := os.LookupEnv(key); ok {
+        return v
+    }
+    return def
+}
+
+// envBool reports whether the named environment variable holds a true value.
+func envBool(key string) bool {
+    v, _ := strconv.ParseBool(os.Getenv(key))
+    return v
+}
+
+// respondError aborts the request with an error in the configured format.
+func respondError(c *gin.Context, status int, message string) {
+    writeError(c, status, message, nil)
+}
+
+// dbReadOnlyRetryAfter is the Retry-After sent while the database refuses
+// writes; see DB_READ_ONLY_RETRY_AFTER.
+var dbReadOnlyRetryAfter = 30 * time.Second
+
+// respondDBError reports a failed database call. Writes refused by a
+// read-only server, as managed databases are during failover, are a
+// retryable 503, as are calls that failed because db was closed under
+// them; anything else is a 500.
+func respondDBError(c *gin.Context, err error) {
+    if dbAvailable() != nil {
+        respondError(c, http.StatusServiceUnavailable, "Database unavailable")
+        return
+    }
+    if isReadOnlyError(err) {
+        c.Header("Retry-After", strconv.Itoa(int(dbReadOnlyRetryAfter.Seconds())))
+        respondError(c, http.StatusServiceUnavailable, "database temporarily read-only")
+        return
+    }
+    respondError(c, http.StatusInternalServerError, err.Error())
+}
+
+// writeError is respondError with optional per-field validation details.
+func writeError(c *gin.Context, status int, message string, fields []fieldError) {
+    if problemErrors {
+        c.Header("Content-Type", "application/problem+json")
+        c.AbortWithStatusJSON(status, problem{
+            Type:     "about:blank",
+            Title:    http.StatusText(status),
+            Status:   status,
+            Detail:   message,
+            Instance: c.Request.URL.Path,
+            Fields:   fields,
+        })
+        return
+    }
+    body := gin.H{"error": message}
+    if fields != nil {
+        body["fields"] = fields
+    }
+    c.AbortWithStatusJSON(status, body)
+}
+
+// respondJSON writes obj as the response body, renaming its keys to
+// camelCase first when JSON_NAMING=camel. The structs keep their snake_case
+// tags, so request bodies and exports are unaffected.
+func respondJSON(c *gin.Context, status int, obj any) {
+    if !camelJSON {
+        c.JSON(status, obj)
+        return
+    }
+    b, err := marshalResponse(obj)
+    if err != nil {
+        respondError(c, http.StatusInternalServerError, err.Error())
+        return
+    }
+    c.Data(status, "application/json; charset=utf-8", b)
+}
+
+// marshalResponse encodes obj as a response body in the configured naming
+// convention.
+func marshalResponse(obj any) ([]byte, error) {
+    b, err := json.Marshal(obj)
+    if err != nil || !camelJSON {
+        return b, err
+    }
+    dec := json.NewDecoder(bytes.NewReader(b))
+    dec.UseNumber()
+    var v any
+    if err := dec.Decode(&v); err != nil {
+        return nil, err
+    }
+    return json.Marshal(camelKeys(v))
+}
+
+// camelKeys renames the keys of every object in v from snake_case to
+// camelCase.
+func camelKeys(v any) any {
+    switch v := v.(type) {
+    case map[string]any:
+        out := make(map[string]any, len(v))
+        for k, e := range v {
+            out[snakeToCamel(k)] = camelKeys(e)
+        }
+        return out
+    case []any:
+        for i, e := range v {
+            v[i] = camelKeys(e)
+        }
+    }
+    return v
+}
+
+// snakeToCamel turns created_at into createdAt.
+func snakeToCamel(s string) string {
+    parts := strings.Split(s, "_")
+    for i := 1; i < len(parts); i++ {
+        if parts[i] != "" {
+            parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+        }
+    }
+    return strings.Join(parts, "")
+}
+
+// bindJSON decodes the request body into obj, responding with 400 and
+// returning false when the body is missing or malformed.
+func bindJSON(c *gin.Context, obj any) bool {
+    if c.Request.Body == nil || c.Request.ContentLength == 0 {
+        respondError(c, http.StatusBadRequest, "request body required")
+        return false
+    }
+    if err := c.ShouldBindJSON(obj); err != nil {
+        // Chunked requests have no Content-Length, so an empty body only
+        // shows up as EOF from the decoder.
+        if errors.Is(err, io.EOF) {
+            respondError(c, http.StatusBadRequest, "request body required")
+            return false
+        }
+        var tooLarge *http.MaxBytesError
+        if errors.As(err, &tooLarge) {
+            respondError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body must be at most %d bytes", tooLarge.Limit))
+            return false
+        }
+        var verrs validator.ValidationErrors
+        if errors.As(err, &verrs) {
+            fields := make([]fieldError, 0, len(verrs))
+            for _, fe := range verrs {
+                fields = append(fields, fieldError{Field: fieldPath(fe), Message: validationMessage(fe)})
+                validationFailures.WithLabelValues(fe.Field()).Inc()
+            }
+            writeError(c, http.StatusBadRequest, "Validation failed", fields)
+            return false
+        }
+        respondError(c, http.StatusBadRequest, err.Error())
+        return false
+    }
+    return true
+}
+
+// useJSONFieldNames makes the validator report failures under the fields'
+// JSON names rather than the Go field names.
+func useJSONFieldNames() {
+    if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+        v.RegisterTagNameFunc(func(f reflect.StructField) string {
+            name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+            if name == "-" {
+                return ""
+            }
+            return name
+        })
+    }
+}
+
+// fieldPath names the failing field by its JSON path below the request
+// body, e.g. "name" or "users[2].email", so errors in nested items point at
+// the offending element.
+func fieldPath(fe validator.FieldError) string {
+    _, path, found := strings.Cut(fe.Namespace(), ".")
+    if !found {
+        return fe.Field()
+    }
+    return path
+}
+
+// checkByteLengths responds with 422 and returns false when name or email is
+// larger, in UTF-8 bytes, than its column can store.
+func checkByteLengths(c *gin.Context, name, email string) bool {
+    if fields := byteLengthErrors("", name, email); fields != nil {
+        writeError(c, http.StatusUnprocessableEntity, "Validation failed", fields)
+        return false
+    }
+    return true
+}
+
+// byteLengthErrors returns an error for name and for email when it is larger
+// than its column, with field names under prefix.
+func byteLengthErrors(prefix, name, email string) []fieldError {
+    var fields []fieldError
+    if len(name) > nameMaxBytes {
+        fields = append(fields, fieldError{Field: prefix + "name", Message: fmt.Sprintf("must be at most %d bytes", nameMaxBytes)})
+        validationFailures.WithLabelValues("name").Inc()
+    }
+    if len(email) > emailMaxBytes {
+        fields = append(fields, fieldError{Field: prefix + "email", Message: fmt.Sprintf("must be at most %d bytes", emailMaxBytes)})
+        validationFailures.WithLabelValues("email").Inc()
+    }
+    return fields
+}
+
+// validationMessage turns a validator failure into a client-facing message.
+func validationMessage(fe validator.FieldError) string {
+    switch fe.Tag() {
+    case "required":
+        return "is required"
+    case "email":
+        return "must be a valid email address"
+    case "max":
+        return "must be at most " + fe.Param() + " characters"
+    }
+    return "failed " + fe.Tag() + " validation"
+}
+
+// parseListParams reads the list filters and paging from the query string,
+// responding with 400 and returning false when one is invalid.
+func parseListParams(c *gin.Context) (listParams, bool) {
+    p := listParams{
+        Email:          c.Query("email"),
+        CreatedBy:      c.Query("created_by"),
+        Search:         c.Query("search"),
+        WithCount:      c.Query("with_count") == "true",
+        IncludeDeleted: c.Query("include_deleted") == "true",
+        EmptyIs404:     c.Query("empty_is_404") == "true",
+        Bare:           c.Query("envelope") == "false" || acceptsBareProfile(c.GetHeader("Accept")),
+        Tenant:         c.GetString(tenantKey),
+    }
+    var ok bool
+    if p.Fields, ok = parseFields(c); !ok {
+        return p, false
+    }
+    p.Sort = defaultSort
+    if v := c.Query("sort"); v != "" {
+        column, desc := strings.CutPrefix(v, "-")
+        if !sortableColumns[column] {
+            respondError(c, http.StatusBadRequest, "Unsupported sort column "+strconv.Quote(column))
+            return p, false
+        }
+        p.Sort = listSort{Column: column, Desc: desc}
+    }
+    if v := c.Query("modified_since"); v != "" {
+        since, err := time.Parse(time.RFC3339, v)
+        if err != nil {
+            respondError(c, http.StatusBadRequest, "modified_since must be an RFC 3339 time")
+            return p, false
+        }
+        since = since.UTC()
+        p.ModifiedSince = &since
+        // Sync clients page through changes oldest first.
+        if _, sorted := c.GetQuery("sort"); !sorted {
+            p.Sort = listSort{Column: "updated_at"}
+        }
+    }
+    if p.IncludeDeleted && !hasScope(c, "users:admin") {
+        respondError(c, http.StatusForbidden, "include_deleted requires scope users:admin")
+        return p, false
+    }
+    if maxLen := currentConfig().SearchMaxLength; utf8.RuneCountInString(p.Search) > maxLen {
+        respondError(c, http.StatusBadRequest, fmt.Sprintf("search must be at most %d characters", maxLen))
+        return p, false
+    }
+    if v := c.Query("ids"); v != "" {
+        raw := strings.Split(v, ",")
+        if len(raw) > maxListIDs {
+            respondError(c, http.StatusBadRequest, fmt.Sprintf("at most %d ids may be requested", maxListIDs))
+            return p, false
+        }
+        for _, r := range raw {
+            id, ok := validUserID(strings.TrimSpace(r))
+            if !ok {
+                respondError(c, http.StatusBadRequest, "Invalid ID "+strconv.Quote(r))
+                return p, false
+            }
+            p.IDs = append(p.IDs, id)
+        }
+    }
+    if v := c.Query("limit"); v != "" {
+        limit, err := strconv.Atoi(v)
+        if err != nil || limit < 1 || limit > maxListLimit {
+            respondError(c, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxListLimit))
+            return p, false
+        }
+        p.Limit = limit
+    }
+    if v := c.Query("offset"); v != "" {
+        offset, err := strconv.Atoi(v)
+        if err != nil || offset < 0 {
+            respondError(c, http.StatusBadRequest, "offset must be a non-negative integer")
+            return p, false
+        }
+        p.Offset = offset
+    }
+    if v := c.Query("cursor"); v != "" {
+        cursor, err := decodeCursor(v)
+        if err != nil {
+            respondError(c, http.StatusBadRequest, "Invalid cursor")
+            return p, false
+        }
+        // The cursor carries its own sort, so ?sort= may be left out.
+        if _, sorted := c.GetQuery("sort"); sorted && (p.Sort.Column != cursor.Column || p.Sort.Desc != cursor.Desc) {
+            respondError(c, http.StatusBadRequest, "cursor does not match sort")
+            return p, false
+        }
+        if p.Offset > 0 || p.Limit == 0 {
+            respondError(c, http.StatusBadRequest, "cursor requires limit and can't be combined with offset")
+            return p, false
+        }
+        p.Sort = listSort{Column: cursor.Column, Desc: cursor.Desc}
+        p.After = &cursor
+    }
+    // The guard looks at the sort and filters, so it runs once they are
+    // all parsed.
+    if queryGuard {
+        if msg := checkListComplexity(p); msg != "" {
+            respondError(c, http.StatusBadRequest, msg)
+            return p, false
+        }
+    }
+    return p, true
+}
+
+// where returns the WHERE clause for p's filters along with its arguments.
+func (p listParams) where() (string, []any) {
+    var conds []string
+    var args []any
+    switch {
+    case p.OnlyDeleted:
+        conds = append(conds, "deleted_at IS NOT NULL")
+    case !p.IncludeDeleted:
+        conds = append(conds, "deleted_at IS NULL")
+    }
+    if p.Tenant != "" {
+        conds = append(conds, "tenant_id = ?")
+        args = append(args, p.Tenant)
+    }
+    if p.ModifiedSince != nil {
+        conds = append(conds, "updated_at >= ?")
+        args = append(args, *p.ModifiedSince)
+    }
+    if a := p.After; a != nil {
+        op := ">"
+        if a.Desc {
+            op = "<"
+        }
+        if a.Column == "id" {
+            conds = append(conds, "id "+op+" ?")
+            args = append(args, a.ID)
+        } else {
+            conds = append(conds, "("+a.Column+" "+op+" ? OR ("+a.Column+" = ? AND id "+op+" ?))")
+            args = append(args, a.Value, a.Value, a.ID)
+        }
+    }
+    if len(p.IDs) > 0 {
+        conds = append(conds, "id IN (?"+strings.Repeat(", ?", len(p.IDs)-1)+")")
+        for _, id := range p.IDs {
+            args = append(args, id)
+        }
+    }
+    if p.Email != "" {
+        if piiCipher != nil {
+            conds = append(conds, "email_hash = ?")
+            args = append(args, piiCipher.hash(p.Email))
+        } else {
+            conds = append(conds, "email = ?")
+            args = append(args, p.Email)
+        }
+    }
+    if p.CreatedBy != "" {
+        conds = append(conds, "created_by = ?")
+        args = append(args, p.CreatedBy)
+    }
+    if p.Search != "" {
+        pattern := "%" + likeEscaper.Replace(p.Search) + "%"
+        // Encrypted emails can't be pattern-matched.
+        if piiCipher != nil {
+            conds = append(conds, "name LIKE ?")
+            args = append(args, pattern)
+        } else {
+            conds = append(conds, "(name LIKE ? OR email LIKE ?)")
+            args = append(args, pattern, pattern)
+        }
+    }
+    if len(conds) == 0 {
+        return "", nil
+    }
+    return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// checkListComplexity rejects filter combinations that make MySQL sort a
+// large share of the table without an index, returning guidance for the
+// client or "" when the query is allowed. An unindexed sort filesorts every
+// matching row, even with a LIMIT, so it needs a filter that narrows the
+// rows through an index: ids, email or created_by. A substring search can't
+// use an index and doesn't count.
+func checkListComplexity(p listParams) string {
+    if indexedSortColumns[p.Sort.Column] {
+        return ""
+    }
+    if len(p.IDs) > 0 || p.Email != "" || p.CreatedBy != "" {
+        return ""
+    }
+    return fmt.Sprintf("sorting by %s needs a filter on ids, email or created_by; sort by id, deleted_at or updated_at instead", p.Sort.Column)
+}
+
+// checkGuardedDefaultSort refuses a default sort that checkListComplexity
+// would reject, since every list without a ?sort= and a selective filter
+// would then fail with 400.
+func checkGuardedDefaultSort(s listSort) error {
+    if !indexedSortColumns[s.Column] {
+        return fmt.Errorf("QUERY_GUARD needs DEFAULT_SORT_COLUMN to be id, deleted_at or updated_at, not %q", s.Column)
+    }
+    return nil
+}
+
+// encodeCursor returns the opaque token for cursor: its JSON and an HMAC of
+// it under cursorKey, both base64url-encoded and joined by a dot.
+func encodeCursor(cursor listCursor) string {
+    b, _ := json.Marshal(cursor)
+    payload := base64.RawURLEncoding.EncodeToString(b)
+    return payload + "." + base64.RawURLEncoding.EncodeToString(cursorMAC(payload))
+}
+
+func cursorMAC(payload string) []byte {
+    mac := hmac.New(sha256.New, cursorKey)
+    mac.Write([]byte(payload))
+    return mac.Sum(nil)
+}
+
+// decodeCursor parses a token from encodeCursor, rejecting anything that
+// isn't one, including tokens whose signature doesn't match.
+func decodeCursor(token string) (listCursor, error) {
+    var cursor listCursor
+    payload, sig, ok := strings.Cut(token, ".")
+    if !ok {
+        return cursor, errors.New("unsigned cursor")
+    }
+    mac, err := base64.RawURLEncoding.DecodeString(sig)
+    if err != nil || !hmac.Equal(mac, cursorMAC(payload)) {
+        return cursor, errors.New("invalid cursor signature")
+    }
+    b, err := base64.RawURLEncoding.DecodeString(payload)
+    if err != nil {
+        return cursor, err
+    }
+    dec := json.NewDecoder(bytes.NewReader(b))
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(&cursor); err != nil {
+        return cursor, err
+    }
+    if !cursorColumns[cursor.Column] {
+        return cursor, fmt.Errorf("unsupported cursor column %q", cursor.Column)
+    }
+    if _, ok := validUserID(string(cursor.ID)); !ok {
+        return cursor, fmt.Errorf("invalid cursor id %q", cursor.ID)
+    }
+    return cursor, nil
+}
+
+// nextCursor returns the cursor continuing after user in p's sort, or ""
+// when the sort doesn't support keyset pagination.
+func (p listParams) nextCursor(user User) string {
+    if !cursorColumns[p.Sort.Column] {
+        return ""
+    }
+    cursor := listCursor{Column: p.Sort.Column, Desc: p.Sort.Desc, ID: user.ID}
+    if p.Sort.Column == "name" {
+        cursor.Value = user.Name
+    }
+    return encodeCursor(cursor)
+}
+
+// orderBy returns the ORDER BY clause for p's sort.
+func (p listParams) orderBy() string {
+    dir := " ASC"
+    if p.Sort.Desc {
+        dir = " DESC"
+    }
+    if p.Sort.Column == "id" {
+        return " ORDER BY id" + dir
+    }
+    return " ORDER BY " + p.Sort.Column + dir + ", id" + dir
+}
+
+// limitClause returns the LIMIT/OFFSET clause for p. Both values are
+// validated integers, so they are formatted into the query directly.
+func (p listParams) limitClause() string {
+    switch {
+    case p.Limit > 0:
+        return fmt.Sprintf(" LIMIT %d OFFSET %d", p.Limit, p.Offset)
+    case p.Offset > 0:
+        // MySQL has no OFFSET without LIMIT.
+        return fmt.Sprintf(" LIMIT %d OFFSET %d", uint64(math.MaxUint64), p.Offset)
+    }
+    return ""
+}
+
+// setPaginationHeaders emits X-Total-Count when total is known and RFC 8288
+// Link headers for the neighbouring pages when the request is paged.
+func setPaginationHeaders(c *gin.Context, p listParams, total *int, hasMore bool) {
+    if total != nil {
+        c.Header("X-Total-Count", strconv.Itoa(*total))
+    }
+    if p.Limit == 0 {
+        return
+    }
+
+    var links []string
+    link := func(offset int, rel string) {
+        links = append(links, fmt.Sprintf(`<%s>; rel="%s"`, pageURL(c, p.Limit, offset), rel))
+    }
+    link(0, "first")
+    if p.Offset > 0 {
+        link(max(p.Offset-p.Limit, 0), "prev")
+    }
+    if hasMore {
+        link(p.Offset+p.Limit, "next")
+    }
+    if total != nil && *total > 0 {
+        link((*total-1)/p.Limit*p.Limit, "last")
+    }
+    c.Header("Link", strings.Join(links, ", "))
+}
+
+// pageURL returns the absolute URL of the current request with its limit and
+// offset replaced.
+func pageURL(c *gin.Context, limit, offset int) string {
+    q := c.Request.URL.Query()
+    q.Set("limit", strconv.Itoa(limit))
+    q.Set("offset", strconv.Itoa(offset))
+    u := url.URL{Scheme: requestScheme(c), Host: c.Request.Host, Path: c.Request.URL.Path, RawQuery: q.Encode()}
+    return u.String()
+}
+
+// trustedProxies are the networks whose X-Forwarded-Proto is believed; see
+// TRUSTED_PROXIES.
+var trustedProxies []netip.Prefix
+
+// parseProxyPrefix parses a TRUSTED_PROXIES entry, either a CIDR or a
+// single address.
+func parseProxyPrefix(s string) (netip.Prefix, error) {
+    if strings.Contains(s, "/") {
+        return netip.ParsePrefix(s)
+    }
+    addr, err := netip.ParseAddr(s)
+    if err != nil {
+        return netip.Prefix{}, err
+    }
+    return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// requestScheme returns the scheme the client used: https on a TLS
+// connection, or whatever a trusted proxy reports in X-Forwarded-Proto when
+// it terminated TLS in front of us.
+func requestScheme(c *gin.Context) string {
+    if c.Request.TLS != nil {
+        return "https"
+    }
+    if addr, err := netip.ParseAddr(c.RemoteIP()); err == nil {
+        for _, prefix := range trustedProxies {
+            if prefix.Contains(addr.Unmap()) {
+                proto, _, _ := strings.Cut(c.GetHeader("X-Forwarded-Proto"), ",")
+                if proto = strings.ToLower(strings.TrimSpace(proto)); proto == "https" {
+                    return proto
+                }
+                break
+            }
+        }
+    }
+    return "http"
+}
+
+// parseUserID reads the :id path parameter, responding with 400 when it is
+// not a valid ID.
+func parseUserID(c *gin.Context) (UserID, bool) {
+    id, ok := validUserID(c.Param("id"))
+    if !ok {
+        respondError(c, http.StatusBadRequest, "Invalid ID")
+    }
+    return id, ok
+}
+
+// validUserID normalizes raw into a UserID, reporting false when it isn't
+// valid for the configured strategy or falls outside the range of the id
+// column.
+func validUserID(raw string) (UserID, bool) {
+    if idStrategy == idStrategyUUID {
+        u, err := uuid.Parse(raw)
+        if err != nil {
+            return "", false
+        }
+        return UserID(u.String()), true
+    }
+
+    id, err := strconv.ParseInt(raw, 10, 64)
+    if err != nil || id < 1 || id > maxUserID {
+        return "", false
+    }
+    return UserID(strconv.FormatInt(id, 10)), true
+}
+
+// @Summary Export users
+// @Description Stream users as CSV, JSON Lines or Parquet, filtered like the list endpoint. The list's fields, envelope, empty_is_404 and with_count don't apply to exports and are rejected with 400.
+// @Produce text/csv
+// @Produce application/x-ndjson
+// @Produce application/vnd.apache.parquet
+// @Param format query string false "Export format (csv, jsonl, parquet); overrides Accept"
+// @Param ids query string false "Comma-separated user IDs to export"
+// @Param email query string false "Only the user with exactly this email"
+// @Param created_by query string false "Only users created by this actor"
+// @Param search query string false "Match a substring of the name, or of the email when it isn't encrypted"
+// @Param limit query int false "Maximum number of users to export"
+// @Param offset query int false "Number of users to skip"
+// @Param include_deleted query bool false "Also export soft-deleted users, with a deleted_at column (admin only)"
+// @Param modified_since query string false "RFC 3339 time; only users updated at or after it"
+// @Param sort query string false "Column to order by (id, name, deleted_at, updated_at); prefix with - for descending"
+// @Param Range header string false "Single byte range to resume a download, e.g. bytes=1024-"
+// @Success 200 {file} file
+// @Success 206 {file} file
+// @Failure 400 {object} map[string]string
+// @Failure 406 {object} map[string]string
+// @Failure 416 {object} map[string]string
+// @Router /users/export [get]
+func exportUsers(c *gin.Context) {
+    name, ok := c.GetQuery("format")
+    if !ok {
+        if name, ok = negotiateExportFormat(c.GetHeader("Accept")); !ok {
+            respondError(c, http.StatusNotAcceptable, "No acceptable export format")
+            return
+        }
+    }
+    format, ok := exportFormats[name]
+    if !ok {
+        respondError(c, http.StatusBadRequest, "Unsupported export format")
+        return
+    }
+
+    for _, param := range exportUnsupportedParams {
+        if _, ok := c.GetQuery(param); ok {
+            respondError(c, http.StatusBadRequest, param+" is not supported on exports")
+            return
+        }
+    }
+    p, ok := parseListParams(c)
+    if !ok {
+        return
+    }
+    modTime, err := exportModTime(c, p)
+    if err != nil {
+        respondDBError(c, err)
+        return
+    }
+    where, args := p.where()
+    rows, err := db.Query(tagQuery(c, "SELECT "+userColumns+" FROM users"+where+p.orderBy()+p.limitClause()), args...)
+    if err != nil {
+        respondDBError(c, err)
+        return
+    }
+    defer rows.Close()
+
+    if c.GetHeader("Range") != "" {
+        serveExportRange(c, rows, name, format, p.IncludeDeleted, modTime)
+        return
+    }
+    setExportHeaders(c, name, format, modTime)
+    c.Status(http.StatusOK)
+
+    // Headers are already sent, so failures past this point can only be logged.
+    out := newDeadlineWriter(c.Writer, streamWriteTimeout)
+    defer out.Close()
+    w := format.newWriter(out, p.IncludeDeleted)
+    written := 0
+    for rows.Next() {
+        user, err := scanUser(rows)
+        if err != nil {
+            log.Printf("export: %v", err)
+            return
+        }
+        if err := w.Write(user); err != nil {
+            log.Printf("export: %v", err)
+            return
+        }
+        written++
+        if written%exportFlushEvery == 0 {
+            if err := w.Flush(); err != nil {
+                log.Printf("export: %v", err)
+                return
+            }
+            if err := out.Flush(); err != nil {
+                log.Printf("export: %v", err)
+                return
+            }
+        }
+    }
+    if err := rows.Err(); err != nil {
+        log.Printf("export: %v", err)
+        return
+    }
+    if err := w.Close(); err != nil {
+        log.Printf("export: %v", err)
+        return
+    }
+    if err := out.Flush(); err != nil {
+        log.Printf("export: %v", err)
+    }
+}
+
+// exportModTime returns when the caller's users last changed, for the
+// export's Last-Modified: a client resuming with If-Range then gets the
+// whole export again if anything was written since its first download. It
+// is read before the export, so a write racing the export can only make the
+// export look older than it is. Rows removed by a purge leave no updated_at
+// behind and aren't noticed.
+//
+// updated_at only has one-second resolution, so a write later in the same
+// second as the newest one doesn't change the result. The zero time, which
+// sends no Last-Modified, is therefore returned while the newest write is
+// less than a second old by the database's clock; such an export can only
+// be resumed with the ETag of a ranged response.
+func exportModTime(c *gin.Context, p listParams) (time.Time, error) {
+    query, args := "SELECT MAX(updated_at), NOW() FROM users", []any(nil)
+    if p.Tenant != "" {
+        query, args = query+" WHERE tenant_id = ?", []any{p.Tenant}
+    }
+    var modTime, now sql.NullTime
+    if err := db.QueryRow(tagQuery(c, query), args...).Scan(&modTime, &now); err != nil || !modTime.Valid {
+        return time.Time{}, err
+    }
+    if now.Time.Sub(modTime.Time) < time.Second {
+        return time.Time{}, nil
+    }
+    return modTime.Time, nil
+}
+
+// setExportHeaders describes an export about to be sent. They are only set
+// once the export is known to succeed, so an error isn't saved as one.
+func setExportHeaders(c *gin.Context, name string, format exportFormat, modTime time.Time) {
+    c.Header("Content-Type", format.contentType)
+    c.Header("Content-Disposition", "attachment; filename=users."+name)
+    c.Header("Accept-Ranges", "bytes")
+    if !modTime.IsZero() {
+        c.Header("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+    }
+}
+
+// serveExportRange answers a Range request for an export. The export is
+// rendered to a temporary file first, since its length isn't known until it
+// is complete, and then served with http.ServeContent, which checks If-Range
+// against modTime or against the ETag, a hash of the rendered export.
+func serveExportRange(c *gin.Context, rows *sql.Rows, name string, format exportFormat, withDeleted bool, modTime time.Time) {
+    f, err := os.CreateTemp("", "users-export-*")
+    if err != nil {
+        respondError(c, http.StatusInternalServerError, err.Error())
+        return
+    }
+    defer os.Remove(f.Name())
+    defer f.Close()
+
+    h := sha256.New()
+    w := format.newWriter(io.MultiWriter(f, h), withDeleted)
+    for rows.Next() {
+        user, err := scanUser(rows)
+        if err != nil {
+            respondDBError(c, err)
+            return
+        }
+        if err := w.Write(user); err != nil {
+            respondError(c, http.StatusInternalServerError, err.Error())
+            return
+        }
+    }
+    if err := rows.Err(); err != nil {
+        respondDBError(c, err)
+        return
+    }
+    if err := w.Close(); err != nil {
+        respondError(c, http.StatusInternalServerError, err.Error())
+        return
+    }
+
+    setExportHeaders(c, name, format, modTime)
+    c.Header("ETag", `"`+hex.EncodeToString(h.Sum(nil)[:16])+`"`)
+    out := newDeadlineWriter(c.Writer, streamWriteTimeout)
+    defer out.Close()
+    http.ServeContent(out, c.Request, "", modTime, f)
+}
+
+// deadlineWriter gives every write and flush to the client its own deadline,
+// so a reader that stops consuming a stream makes the handler fail fast and
+// release its rows and goroutine instead of blocking until WriteTimeout.
+// It is also an http.ResponseWriter, so http.ServeContent can write through
+// it.
+type deadlineWriter struct {
+    w       http.ResponseWriter
+    rc      *http.ResponseController
+    timeout time.Duration
+}
+
+func newDeadlineWriter(w http.ResponseWriter, timeout time.Duration) *deadlineWriter {
+    return &deadlineWriter{w: w, rc: http.NewResponseController(w), timeout: timeout}
+}
+
+func (d *deadlineWriter) extend() error {
+    err := d.rc.SetWriteDeadline(time.Now().Add(d.timeout))
+    if errors.Is(err, http.ErrNotSupported) {
+        return nil
+    }
+    return err
+}
+
+func (d *deadlineWriter) Header() http.Header {
+    return d.w.Header()
+}
+
+func (d *deadlineWriter) WriteHeader(status int) {
+    d.w.WriteHeader(status)
+}
+
+func (d *deadlineWriter) Write(b []byte) (int, error) {
+    if err := d.extend(); err != nil {
+        return 0, err
+    }
+    return d.w.Write(b)
+}
+
+func (d *deadlineWriter) Flush() error {
+    if err := d.extend(); err != nil {
+        return err
+    }
+    return d.rc.Flush()
+}
+
+// Close clears the deadline so it doesn't carry over to the next request on
+// a kept-alive connection.
+func (d *deadlineWriter) Close() error {
+    err := d.rc.SetWriteDeadline(time.Time{})
+    if errors.Is(err, http.ErrNotSupported) {
+        return nil
+    }
+    return err
+}
+
+// negotiateExportFormat picks the export format for an Accept header, trying
+// media ranges in order of preference. A missing header or */* selects
+// exportDefaultFormat; ok is false when nothing acceptable is offered.
+func negotiateExportFormat(accept string) (name string, ok bool) {
+    if strings.TrimSpace(accept) == "" {
+        return exportDefaultFormat, true
+    }
+    type mediaRange struct {
+        typ string
+        q   float64
+    }
+    var ranges []mediaRange
+    for _, part := range negotiationEntries(accept) {
+        typ, params, _ := strings.Cut(part, ";")
+        q, ok := parseQValue(params)
+        if ok && q > 0 {
+            ranges = append(ranges, mediaRange{typ: strings.ToLower(strings.TrimSpace(typ)), q: q})
+        }
+    }
+    sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+    for _, r := range ranges {
+        if r.typ == "*/*" {
+            return exportDefaultFormat, true
+        }
+        for name, format := range exportFormats {
+            if format.contentType == r.typ {
+                return name, true
+            }
+        }
+    }
+    return "", false
+}
+
+type csvExportWriter struct {
+    w           *csv.Writer
+    withDeleted bool
+}
+
+func newCSVExportWriter(w io.Writer, withDeleted bool) exportWriter {
+    cw := csv.NewWriter(w)
+    header := []string{"id", "name", "email"}
+    if withDeleted {
+        header = append(header, "deleted_at")
+    }
+    cw.Write(header)
+    return &csvExportWriter{w: cw, withDeleted: withDeleted}
+}
+
+func (e *csvExportWriter) Write(user User) error {
+    record := []string{string(user.ID), user.Name, user.Email}
+    if e.withDeleted {
+        deletedAt := ""
+        if user.DeletedAt != nil {
+            deletedAt = user.DeletedAt.UTC().Format(time.RFC3339)
+        }
+        record = append(record, deletedAt)
+    }
+    return e.w.Write(record)
+}
+
+func (e *csvExportWriter) Flush() error {
+    e.w.Flush()
+    return e.w.Error()
+}
+
+func (e *csvExportWriter) Close() error {
+    return e.Flush()
+}
+
+type jsonlExportWriter struct {
+    enc *json.Encoder
+}
+
+func newJSONLExportWriter(w io.Writer, _ bool) exportWriter {
+    return &jsonlExportWriter{enc: json.NewEncoder(w)}
+}
+
+func (e *jsonlExportWriter) Write(user User) error {
+    return e.enc.Encode(user)
+}
+
+func (e *jsonlExportWriter) Flush() error {
+    return nil
+}
+
+func (e *jsonlExportWriter) Close() error {
+    return nil
+}
+
+// parquetExportWriter ends a row group on every Flush so that memory use is
+// bounded by exportFlushEvery rows rather than the whole table.
+type parquetExportWriter struct {
+    w *parquet.GenericWriter[User]
+}
+
+func newParquetExportWriter(w io.Writer, _ bool) exportWriter {
+    return &parquetExportWriter{w: parquet.NewGenericWriter[User](w)}
+}
+
+func (e *parquetExportWriter) Write(user User) error {
+    _, err := e.w.Write([]User{user})
+    return err
+}
+
+func (e *parquetExportWriter) Flush() error {
+    return e.w.Flush()
+}
+
+func (e *parquetExportWriter) Close() error {
+    return e.w.Close()
+}
+
+EOL
+
+# The MySQL driver is chosen at build time: go-sql-driver/mysql by default,
+# or ziutek/mymysql with -tags mymysql (BUILD_TAGS=mymysql in Docker).
+cat > driver_mysql.go << 'EOL'
+//go:build !mymysql
+
+package main
+
+import (
+    "errors"
+    "fmt"
+
+    "github.com/go-sql-driver/mysql"
+)
+
+const driverName = "mysql"
+
+// isReadOnlyError reports whether err is ER_OPTION_PREVENTS_STATEMENT (1290),
+// which a server running with --read-only returns for writes.
+func isReadOnlyError(err error) bool {
+    var myErr *mysql.MySQLError
+    return errors.As(err, &myErr) && myErr.Number == 1290
+}
+
+// buildDSN returns a go-sql-driver/mysql DSN. parseTime makes DATETIME
+// columns scan into time.Time.
+func buildDSN(host, user, password, name string) string {
+    return fmt.Sprintf("%s:%s@tcp(%s:3306)/%s?parseTime=true", user, password, host, name)
+}
+EOL
+
+cat > driver_mymysql.go << 'EOL'
+//go:build mymysql
+
+package main
+
+import (
+    "errors"
+    "fmt"
+
+    _ "github.com/ziutek/mymysql/godrv"
+    "github.com/ziutek/mymysql/mysql"
+)
+
+const driverName = "mymysql"
+
+// isReadOnlyError reports whether err is ER_OPTION_PREVENTS_STATEMENT (1290),
+// which a server running with --read-only returns for writes.
+func isReadOnlyError(err error) bool {
+    var myErr *mysql.Error
+    return errors.As(err, &myErr) && myErr.Code == 1290
+}
+
+// buildDSN returns a mymysql DSN (tcp:ADDR*DBNAME/USER/PASSWD). mymysql
+// returns DATETIME as time.Time without a parseTime option, and its format
+// has no escaping, so the user and password must not contain '/'.
+func buildDSN(host, user, password, name string) string {
+    return fmt.Sprintf("tcp:%s:3306*%s/%s/%s", host, name, user, password)
+}
+EOL
+
+# Each driver file has its own tests, run with the same build tag.
+cat > driver_mysql_test.go << 'EOL'
+//go:build !mymysql
+
+package main
+
+import (
+    "fmt"
+    "testing"
+
+    "github.com/go-sql-driver/mysql"
+)
+
+// readOnlyErr returns the error the driver reports for a write to a
+// read-only server.
+func readOnlyErr() error {
+    return &mysql.MySQLError{Number: 1290, Message: "The MySQL server is running with the --read-only option"}
+}
+
+func TestBuildDSN(t *testing.T) {
+    cfg, err := mysql.ParseDSN(buildDSN("db", "app", "p@ss:word", "users"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if cfg.Addr != "db:3306" || cfg.User != "app" || cfg.Passwd != "p@ss:word" || cfg.DBName != "users" || !cfg.ParseTime {
+        t.Errorf("parsed DSN = %+v", cfg)
+    }
+}
+
+func TestIsReadOnlyError(t *testing.T) {
+    if !isReadOnlyError(fmt.Errorf("update: %w", readOnlyErr())) {
+        t.Error("wrapped 1290 not recognised")
+    }
+    if isReadOnlyError(&mysql.MySQLError{Number: 1062}) {
+        t.Error("duplicate key treated as read-only")
+    }
+}
+EOL
+cat > driver_mymysql_test.go << 'EOL'
+//go:build mymysql
+
+package main
+
+import (
+    "fmt"
+    "testing"
+
+    "github.com/ziutek/mymysql/mysql"
+)
+
+// readOnlyErr returns the error the driver reports for a write to a
+// read-only server.
+func readOnlyErr() error {
+    return &mysql.Error{Code: 1290, Msg: []byte("The MySQL server is running with the --read-only option")}
+}
+
+func TestBuildDSN(t *testing.T) {
+    if got, want := buildDSN("db", "app", "secret", "users"), "tcp:db:3306*users/app/secret"; got != want {
+        t.Errorf("buildDSN = %q, want %q", got, want)
+    }
+}
+
+func TestIsReadOnlyError(t *testing.T) {
+    if !isReadOnlyError(fmt.Errorf("update: %w", readOnlyErr())) {
+        t.Error("wrapped 1290 not recognised")
+    }
+    if isReadOnlyError(&mysql.Error{Code: 1062}) {
+        t.Error("duplicate key treated as read-only")
+    }
+}
+EOL
+
+# Handler tests run against go-sqlmock instead of a database: go test ./...
+cat > main_test.go << 'EOL'
+package main
+
+import (
+    "bytes"
+    "compress/gzip"
+    "context"
+    "database/sql"
+    "database/sql/driver"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "net/netip"
+    "net/url"
+    "os"
+    "os/signal"
+    "path/filepath"
+    "reflect"
+    "regexp"
+    "slices"
+    "strconv"
+    "strings"
+    "sync"
+    "syscall"
+    "testing"
+    "time"
+
+    "github.com/DATA-DOG/go-sqlmock"
+    "github.com/gin-gonic/gin"
+    "github.com/google/uuid"
+    "github.com/parquet-go/parquet-go"
+    "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMain(m *testing.M) {
+    gin.SetMode(gin.TestMode)
+    gin.DefaultWriter = io.Discard
+    activeConfig.Store(loadRuntimeConfig())
+    useJSONFieldNames()
+    os.Exit(m.Run())
+}
+
+// setGlobal sets *p to v for the rest of the test.
+func setGlobal[T any](t *testing.T, p *T, v T) {
+    t.Helper()
+    old := *p
+    *p = v
+    t.Cleanup(func() { *p = old })
+}
+
+// mockDB replaces db with a sqlmock for the rest of the test, which fails if
+// an expected statement didn't run.
+func mockDB(t *testing.T) sqlmock.Sqlmock {
+    t.Helper()
+    mdb, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatal(err)
+    }
+    setGlobal(t, &db, mdb)
+    t.Cleanup(func() {
+        if err := mock.ExpectationsWereMet(); err != nil {
+            t.Error(err)
+        }
+        mdb.Close()
+    })
+    return mock
+}
+
+// userRows returns mock rows of userColumns holding users.
+func userRows(users ...User) *sqlmock.Rows {
+    rows := sqlmock.NewRows([]string{"id", "name", "email", "deleted_at", "updated_at"})
+    for _, u := range users {
+        var deletedAt, updatedAt any
+        if u.DeletedAt != nil {
+            deletedAt = *u.DeletedAt
+        }
+        if u.UpdatedAt != nil {
+            updatedAt = *u.UpdatedAt
+        }
+        rows.AddRow(string(u.ID), u.Name, u.Email, deletedAt, updatedAt)
+    }
+    return rows
+}
+
+// serve sends a request through h and returns the recorded response. header
+// holds name, value pairs; a body is sent as JSON.
+func serve(h http.Handler, method, target, body string, header ...string) *httptest.ResponseRecorder {
+    var r io.Reader
+    if body != "" {
+        r = strings.NewReader(body)
+    }
+    req := httptest.NewRequest(method, target, r)
+    if body != "" {
+        req.Header.Set("Content-Type", "application/json")
+    }
+    for i := 0; i+1 < len(header); i += 2 {
+        req.Header.Set(header[i], header[i+1])
+    }
+    w := httptest.NewRecorder()
+    h.ServeHTTP(w, req)
+    return w
+}
+
+var exportedUsers = []User{
+    {ID: "1", Name: "John Doe", Email: "john@example.com"},
+    {ID: "2", Name: "Jane Smith", Email: "jane@example.com"},
+}
+
+func exportRouter() *gin.Engine {
+    r := gin.New()
+    r.GET("/users/export", exportUsers)
+    return r
+}
+
+// exportedModTime is when the exported users last changed.
+var exportedModTime = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// expectExportModTime expects the query for an export's Last-Modified.
+func expectExportModTime(mock sqlmock.Sqlmock) {
+    expectExportModTimeAt(mock, exportedModTime, exportedModTime.Add(time.Hour))
+}
+
+// expectExportModTimeAt is expectExportModTime with the users last changed
+// at modTime, as read at now by the database's clock.
+func expectExportModTimeAt(mock sqlmock.Sqlmock, modTime, now time.Time) {
+    mock.ExpectQuery(regexp.QuoteMeta("SELECT MAX(updated_at), NOW() FROM users")).
+        WillReturnRows(sqlmock.NewRows([]string{"MAX(updated_at)", "NOW()"}).AddRow(modTime, now))
+}
+
+func TestExportJSONLines(t *testing.T) {
+    mock := mockDB(t)
+    expectExportModTime(mock)
+    mock.ExpectQuery("SELECT id, name, email, deleted_at, updated_at FROM users").WillReturnRows(userRows(exportedUsers...))
+
+    w := serve(exportRouter(), "GET", "/users/export?format=jsonl", "")
+    if w.Code != http.StatusOK {
+        t.Fatalf("status = %d, body %s", w.Code, w.Body)
+    }
+    if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+        t.Errorf("Content-Type = %q", ct)
+    }
+    lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+    if len(lines) != len(exportedUsers) {
+        t.Fatalf("got %d lines, want %d: %q", len(lines), len(exportedUsers), w.Body)
+    }
+    for i, line := range lines {
+        var user User
+        if err := json.Unmarshal([]byte(line), &user); err != nil {
+            t.Fatalf("line %d: %v", i+1, err)
+        }
+        if user.ID != exportedUsers[i].ID || user.Email != exportedUsers[i].Email {
+            t.Errorf("line %d = %+v, want %+v", i+1, user, exportedUsers[i])
+        }
+    }
+}
+
+func TestExportParquetSchema(t *testing.T) {
+    mock := mockDB(t)
+    expectExportModTime(mock)
+    mock.ExpectQuery("SELECT id, name, email, deleted_at, updated_at FROM users").WillReturnRows(userRows(exportedUsers...))
+
+    w := serve(exportRouter(), "GET", "/users/export?format=parquet", "")
+    if w.Code != http.StatusOK {
+        t.Fatalf("status = %d, body %s", w.Code, w.Body)
+    }
+    f, err := parquet.OpenFile(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+    if err != nil {
+        t.Fatal(err)
+    }
+    var got []string
+    for _, field := range f.Schema().Fields() {
+        got = append(got, field.Name())
+        if optional := field.Name() == "deleted_at"; field.Optional() != optional {
+            t.Errorf("%s: optional = %v, want %v", field.Name(), field.Optional(), optional)
+        }
+    }
+    if want := "id,name,email,deleted_at"; strings.Join(got, ",") != want {
+        t.Errorf("columns = %v, want %s", got, want)
+    }
+    if n := f.NumRows(); n != int64(len(exportedUsers)) {
+        t.Errorf("rows = %d, want %d", n, len(exportedUsers))
+    }
+
+    rows := make([]User, len(exportedUsers))
+    reader := parquet.NewGenericReader[User](bytes.NewReader(w.Body.Bytes()))
+    if n, err := reader.Read(rows); n != len(rows) && err != nil {
+        t.Fatal(err)
+    }
+    for i, user := range rows {
+        if user.ID != exportedUsers[i].ID || user.Name != exportedUsers[i].Name {
+            t.Errorf("row %d = %+v, want %+v", i, user, exportedUsers[i])
+        }
+    }
+}
+
+func TestExportFormatDefaultsAndUnknown(t *testing.T) {
+    mock := mockDB(t)
+    expectExportModTime(mock)
+    mock.ExpectQuery("SELECT id, name, email, deleted_at, updated_at FROM users").WillReturnRows(userRows(exportedUsers...))
+
+    w := serve(exportRouter(), "GET", "/users/export", "")
+    if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/csv" {
+        t.Fatalf("default export: status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+    }
+    if want := "id,name,email\n1,John Doe,john@example.com\n2,Jane Smith,jane@example.com\n"; w.Body.String() != want {
+        t.Errorf("body = %q, want %q", w.Body, want)
+    }
+
+    if w := serve(exportRouter(), "GET", "/users/export?format=xml", ""); w.Code != http.StatusBadRequest {
+        t.Errorf("unknown format: status = %d, want 400", w.Code)
+    }
+}
+
+func TestGetUserRejectsOutOfRangeID(t *testing.T) {
+    mockDB(t) // no query is expected
+    r := gin.New()
+    r.GET("/users/:id", getUser)
+    for _, id := range []string{"99999999999999999999999999", "2147483648", "0", "-1", "abc"} {
+        w := serve(r, "GET", "/users/"+id, "")
+        if w.Code != http.StatusBadRequest {
+            t.Errorf("GET /users/%s: status = %d, want 400", id, w.Code)
+        }
+        if !strings.Contains(w.Body.String(), "Invalid ID") {
+            t.Errorf("GET /users/%s: body = %s", id, w.Body)
+        }
+    }
+}
+
+// withConfig swaps in a copy of the active runtime config changed by edit
+// for the rest of the test.
+func withConfig(t *testing.T, edit func(cfg *runtimeConfig)) {
+    t.Helper()
+    old := currentConfig()
+    cfg := *old
+    edit(&cfg)
+    activeConfig.Store(&cfg)
+    t.Cleanup(func() { activeConfig.Store(old) })
+}
+
+func TestReadyzWithFailingDatabase(t *testing.T) {
+    setGlobal(t, &db, nil)
+    r := gin.New()
+    r.GET("/readyz", readyz)
+
+    for _, tc := range []struct {
+        always200 bool
+        want      int
+    }{
+        {false, http.StatusServiceUnavailable},
+        {true, http.StatusOK},
+    } {
+        withConfig(t, func(cfg *runtimeConfig) { cfg.HealthAlways200 = tc.always200 })
+        w := serve(r, "GET", "/readyz", "")
+        if w.Code != tc.want {
+            t.Errorf("HEALTH_ALWAYS_200=%v: status = %d, want %d", tc.always200, w.Code, tc.want)
+        }
+        var body map[string]string
+        if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body["status"] != "unavailable" {
+            t.Errorf("HEALTH_ALWAYS_200=%v: body = %s", tc.always200, w.Body)
+        }
+    }
+}
+
+func TestMergePutsKeepEachOthersChanges(t *testing.T) {
+    mock := mockDB(t)
+    selectForUpdate := regexp.QuoteMeta("SELECT " + userColumns + " FROM users WHERE id = ? AND deleted_at IS NULL FOR UPDATE")
+    r := gin.New()
+    r.PUT("/users/:id", updateUser)
+
+    // Both clients read John Doe <john@example.com>; one renames him, the
+    // other changes his email, each sending only the field it changed.
+    mock.ExpectBegin()
+    mock.ExpectQuery(selectForUpdate).WithArgs("1").WillReturnRows(userRows(User{ID: "1", Name: "John Doe", Email: "john@example.com"}))
+    mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET name = ? WHERE id = ?")).WithArgs("Johnny", "1").WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+    if w := serve(r, "PUT", "/users/1?merge=true", `{"name":"Johnny"}`); w.Code != http.StatusOK {
+        t.Fatalf("first PUT: status = %d, body %s", w.Code, w.Body)
+    }
+
+    mock.ExpectBegin()
+    mock.ExpectQuery(selectForUpdate).WithArgs("1").WillReturnRows(userRows(User{ID: "1", Name: "Johnny", Email: "john@example.com"}))
+    mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET email = ?, email_hash = ? WHERE id = ?")).WithArgs("johnny@example.com", nil, "1").WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+    w := serve(r, "PUT", "/users/1?merge=true", `{"email":"johnny@example.com"}`)
+    if w.Code != http.StatusOK {
+        t.Fatalf("second PUT: status = %d, body %s", w.Code, w.Body)
+    }
+    var user User
+    if err := json.Unmarshal(w.Body.Bytes(), &user); err != nil {
+        t.Fatal(err)
+    }
+    if user.Name != "Johnny" || user.Email != "johnny@example.com" {
+        t.Errorf("merged user = %+v, want both changes", user)
+    }
+}
+
+// actingAs stands in for apiKeyAuth, authenticating every request as actor.
+func actingAs(actor string) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        c.Set(actorKey, actor)
+        c.Next()
+    }
+}
+
+func TestCreatedByIsStampedAndFiltered(t *testing.T) {
+    mock := mockDB(t)
+    r := gin.New()
+    r.Use(actingAs("alice"))
+    r.POST("/users", createUser)
+    r.GET("/users", getUsers)
+
+    mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users (name, email, email_hash, created_by, tenant_id) VALUES (?, ?, ?, ?, ?)")).
+        WithArgs("Ann", "ann@example.com", nil, "alice", nil).
+        WillReturnResult(sqlmock.NewResult(7, 1))
+    if w := serve(r, "POST", "/users", `{"name":"Ann","email":"ann@example.com"}`); w.Code != http.StatusCreated {
+        t.Fatalf("create: status = %d, body %s", w.Code, w.Body)
+    }
+
+    mock.ExpectQuery(regexp.QuoteMeta("FROM users WHERE deleted_at IS NULL AND created_by = ? ORDER BY id ASC")).
+        WithArgs("alice").
+        WillReturnRows(userRows(User{ID: "7", Name: "Ann", Email: "ann@example.com"}))
+    w := serve(r, "GET", "/users?created_by=alice", "")
+    if w.Code != http.StatusOK {
+        t.Fatalf("list: status = %d, body %s", w.Code, w.Body)
+    }
+    var list struct{ Data []User }
+    if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+        t.Fatal(err)
+    }
+    if len(list.Data) != 1 || list.Data[0].ID != "7" {
+        t.Errorf("data = %+v, want only user 7", list.Data)
+    }
+}
+
+// captureLogs sends the default slog logger's output, at every level, to
+// the returned buffer for the rest of the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+    t.Helper()
+    var buf bytes.Buffer
+    old := slog.Default()
+    slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+    t.Cleanup(func() { slog.SetDefault(old) })
+    return &buf
+}
+
+func TestErrorLoggerSamplesClientErrors(t *testing.T) {
+    r := gin.New()
+    r.Use(errorLogger())
+    r.GET("/status/:code", func(c *gin.Context) {
+        code, _ := strconv.Atoi(c.Param("code"))
+        c.Status(code)
+    })
+
+    withConfig(t, func(cfg *runtimeConfig) { cfg.ClientErrorSampleRate = 0 })
+    logs := captureLogs(t)
+    for i := 0; i < 20; i++ {
+        serve(r, "GET", "/status/404", "")
+    }
+    if logs.Len() != 0 {
+        t.Errorf("4xx logged with LOG_4XX_SAMPLE_RATE=0: %s", logs)
+    }
+    serve(r, "GET", "/status/500", "")
+    if !strings.Contains(logs.String(), "level=ERROR") || !strings.Contains(logs.String(), "status=500") {
+        t.Errorf("5xx not logged: %q", logs)
+    }
+
+    withConfig(t, func(cfg *runtimeConfig) { cfg.ClientErrorSampleRate = 1 })
+    logs.Reset()
+    serve(r, "GET", "/status/404", "")
+    if !strings.Contains(logs.String(), "level=WARN") || !strings.Contains(logs.String(), "status=404") {
+        t.Errorf("4xx not logged with LOG_4XX_SAMPLE_RATE=1: %q", logs)
+    }
+}
+
+func TestUUIDStrategy(t *testing.T) {
+    setGlobal(t, &idStrategy, idStrategyUUID)
+    mock := mockDB(t)
+    r := gin.New()
+    r.POST("/users", createUser)
+    r.GET("/users/:id", getUser)
+
+    mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users (id, name, email, email_hash, created_by, tenant_id) VALUES (?, ?, ?, ?, ?, ?)")).
+        WithArgs(sqlmock.AnyArg(), "Ann", "ann@example.com", nil, nil, nil).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    w := serve(r, "POST", "/users", `{"name":"Ann","email":"ann@example.com"}`)
+    if w.Code != http.StatusCreated {
+        t.Fatalf("create: status = %d, body %s", w.Code, w.Body)
+    }
+    var created map[string]any
+    if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+        t.Fatal(err)
+    }
+    id, _ := created["id"].(string)
+    if _, err := uuid.Parse(id); err != nil {
+        t.Fatalf("created id %v is not a UUID: %v", created["id"], err)
+    }
+
+    mock.ExpectQuery(regexp.QuoteMeta("FROM users WHERE id = ?")).
+        WithArgs(id).
+        WillReturnRows(userRows(User{ID: UserID(id), Name: "Ann", Email: "ann@example.com"}))
+    if w := serve(r, "GET", "/users/"+strings.ToUpper(id), ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"id":"`+id+`"`) {
+        t.Errorf("lookup by UUID: status = %d, body %s", w.Code, w.Body)
+    }
+    if w := serve(r, "GET", "/users/1", ""); w.Code != http.StatusBadRequest {
+        t.Errorf("integer id under uuid strategy: status = %d, want 400", w.Code)
+    }
+}
+
+func TestEmptyBodyIsFriendly400(t *testing.T) {
+    mockDB(t) // nothing may reach the database
+    r := gin.New()
+    r.POST("/users", createUser)
+    r.PUT("/users/:id", updateUser)
+
+    for _, target := range []string{"POST /users", "PUT /users/1", "PUT /users/1?merge=true"} {
+        method, path, _ := strings.Cut(target, " ")
+        w := serve(r, method, path, "")
+        if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "request body required") {
+            t.Errorf("%s: status = %d, body %s", target, w.Code, w.Body)
+        }
+
+        // A chunked request has no Content-Length to go by.
+        req := httptest.NewRequest(method, path, nil)
+        req.Body = io.NopCloser(strings.NewReader(""))
+        req.ContentLength = -1
+        w = httptest.NewRecorder()
+        r.ServeHTTP(w, req)
+        if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "request body required") {
+            t.Errorf("chunked %s: status = %d, body %s", target, w.Code, w.Body)
+        }
+    }
+}
+
+func TestListCacheControl(t *testing.T) {
+    mock := mockDB(t)
+    withConfig(t, func(cfg *runtimeConfig) { cfg.CacheControlList = "private, max-age=30" })
+    r := gin.New()
+    r.GET("/users", cacheControl(func(cfg *runtimeConfig) string { return cfg.CacheControlList }), getUsers)
+
+    mock.ExpectQuery("FROM users").WillReturnRows(userRows(exportedUsers...))
+    w := serve(r, "GET", "/users", "")
+    if got := w.Header().Get("Cache-Control"); got != "private, max-age=30" {
+        t.Errorf("Cache-Control = %q, want the CACHE_CONTROL_LIST policy", got)
+    }
+
+    withConfig(t, func(cfg *runtimeConfig) { cfg.CacheControlList = "" })
+    mock.ExpectQuery("FROM users").WillReturnRows(userRows(exportedUsers...))
+    if w := serve(r, "GET", "/users", ""); w.Header().Get("Cache-Control") != "" {
+        t.Errorf("Cache-Control = %q with no policy configured", w.Header().Get("Cache-Control"))
+    }
+}
+
+func TestSearchLengthCapAndLiteralMatch(t *testing.T) {
+    mock := mockDB(t)
+    withConfig(t, func(cfg *runtimeConfig) { cfg.SearchMaxLength = 5 })
+    r := gin.New()
+    r.GET("/users", getUsers)
+
+    if w := serve(r, "GET", "/users?search=abcdef", ""); w.Code != http.StatusBadRequest {
+        t.Errorf("6-character search: status = %d, want 400", w.Code)
+    }
+
+    // Five characters of multibyte text are within the cap, and % and _
+    // must match themselves rather than act as wildcards.
+    mock.ExpectQuery(regexp.QuoteMeta("(name LIKE ? OR email LIKE ?)")).
+        WithArgs(`%é50\%\_%`, `%é50\%\_%`).
+        WillReturnRows(userRows())
+    if w := serve(r, "GET", "/users?"+url.Values{"search": {"é50%_"}}.Encode(), ""); w.Code != http.StatusOK {
+        t.Errorf("search with wildcards: status = %d, body %s", w.Code, w.Body)
+    }
+}
+
+func TestCountOnlyWhenRequested(t *testing.T) {
+    // sqlmock fails any statement it wasn't told to expect, so the first
+    // request proves no COUNT(*) runs without with_count.
+    mock := mockDB(t)
+    r := gin.New()
+    r.GET("/users", getUsers)
+
+    mock.ExpectQuery("SELECT id, name").WillReturnRows(userRows(exportedUsers...))
+    w := serve(r, "GET", "/users?limit=2", "")
+    if w.Code != http.StatusOK || w.Header().Get("X-Total-Count") != "" || strings.Contains(w.Body.String(), `"total"`) {
+        t.Errorf("without with_count: status %d, X-Total-Count %q, body %s", w.Code, w.Header().Get("X-Total-Count"), w.Body)
+    }
+
+    mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM users")).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(5))
+    mock.ExpectQuery("SELECT id, name").WillReturnRows(userRows(exportedUsers...))
+    w = serve(r, "GET", "/users?limit=2&with_count=true", "")
+    if w.Header().Get("X-Total-Count") != "5" || !strings.Contains(w.Body.String(), `"total":5`) {
+        t.Errorf("with_count=true: X-Total-Count %q, body %s", w.Header().Get("X-Total-Count"), w.Body)
+    }
+}
+
+var testAPIKeys = []apiKey{
+    {Name: "reader", Key: "read-key", Scopes: []string{"users:read"}},
+    {Name: "writer", Key: "write-key", Scopes: []string{"users:read", "users:write"}},
+    {Name: "admin", Key: "admin-key", Scopes: []string{"users:read", "users:write", "users:admin"}},
+}
+
+func TestReadOnlyKeyIsDeniedWrites(t *testing.T) {
+    mock := mockDB(t)
+    r := gin.New()
+    r.Use(apiKeyAuth(testAPIKeys))
+    r.POST("/users", requireScope("users:write"), createUser)
+    body := `{"name":"Ann","email":"ann@example.com"}`
+
+    if w := serve(r, "POST", "/users", body, "X-API-Key", "read-key"); w.Code != http.StatusForbidden {
+        t.Errorf("read-only key: status = %d, want 403", w.Code)
+    }
+    if w := serve(r, "POST", "/users", body); w.Code != http.StatusUnauthorized {
+        t.Errorf("no key: status = %d, want 401", w.Code)
+    }
+    mock.ExpectExec("INSERT INTO users").WithArgs("Ann", "ann@example.com", nil, "writer", nil).WillReturnResult(sqlmock.NewResult(1, 1))
+    if w := serve(r, "POST", "/users", body, "X-API-Key", "write-key"); w.Code != http.StatusCreated {
+        t.Errorf("write key: status = %d, body %s", w.Code, w.Body)
+    }
+}
+
+func TestValidationReportsEveryField(t *testing.T) {
+    mockDB(t)
+    r := gin.New()
+    r.POST("/users", createUser)
+
+    w := serve(r, "POST", "/users", `{"name":"","email":"not-an-email"}`)
+    if w.Code != http.StatusBadRequest {
+        t.Fatalf("status = %d, want 400", w.Code)
+    }
+    var body struct {
+        Fields []fieldError `json:"fields"`
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+        t.Fatal(err)
+    }
+    got := map[string]string{}
+    for _, f := range body.Fields {
+        got[f.Field] = f.Message
+    }
+    if got["name"] != "is required" || got["email"] != "must be a valid email address" || len(got) != 2 {
+        t.Errorf("fields = %+v, want name and email", body.Fields)
+    }
+}
+
+func TestSIGHUPReloadsReloadableSettings(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "app.env")
+    if err := os.WriteFile(path, []byte("SEARCH_MAX_LENGTH=7\nDB_HOST=elsewhere\n"), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    t.Setenv("SEARCH_MAX_LENGTH", "100")
+    t.Setenv("DB_HOST", "db")
+    withConfig(t, func(*runtimeConfig) {})
+
+    // Until watchReload has subscribed, a SIGHUP would kill the test binary.
+    guard := make(chan os.Signal, 1)
+    signal.Notify(guard, syscall.SIGHUP)
+    defer signal.Stop(guard)
+    go watchReload(path)
+
+    deadline := time.Now().Add(5 * time.Second)
+    for currentConfig().SearchMaxLength != 7 {
+        if time.Now().After(deadline) {
+            t.Fatalf("SearchMaxLength = %d after SIGHUP, want 7", currentConfig().SearchMaxLength)
+        }
+        syscall.Kill(os.Getpid(), syscall.SIGHUP)
+        time.Sleep(20 * time.Millisecond)
+    }
+    if got := os.Getenv("DB_HOST"); got != "db" {
+        t.Errorf("non-reloadable DB_HOST changed to %q on reload", got)
+    }
+}
+
+func TestListByIDsSkipsMissing(t *testing.T) {
+    mock := mockDB(t)
+    r := gin.New()
+    r.GET("/users", getUsers)
+
+    mock.ExpectQuery(regexp.QuoteMeta("id IN (?, ?, ?)")).
+        WithArgs("1", "2", "999").
+        WillReturnRows(userRows(exportedUsers...))
+    w := serve(r, "GET", "/users?ids=1,2,999", "")
+    var list struct{ Data []User }
+    if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+        t.Fatal(err)
+    }
+    if w.Code != http.StatusOK || len(list.Data) != 2 || list.Data[0].ID != "1" || list.Data[1].ID != "2" {
+        t.Errorf("status %d, data %+v, want users 1 and 2 only", w.Code, list.Data)
+    }
+
+    if w := serve(r, "GET", "/users?ids=1,x", ""); w.Code != http.StatusBadRequest {
+        t.Errorf("invalid id: status = %d, want 400", w.Code)
+    }
+    if w := serve(r, "GET", "/users?ids=1"+strings.Repeat(",1", maxListIDs), ""); w.Code != http.StatusBadRequest {
+        t.Errorf("%d ids: status = %d, want 400", maxListIDs+1, w.Code)
+    }
+}
+
+func TestChaosInjectsAtConfiguredRate(t *testing.T) {
+    count := func(cfg chaosConfig, path string) int {
+        r := gin.New()
+        r.Use(chaos(cfg))
+        r.GET("/users", func(c *gin.Context) { c.Status(http.StatusOK) })
+        r.GET("/readyz", func(c *gin.Context) { c.Status(http.StatusOK) })
+        injected := 0
+        for i := 0; i < 2000; i++ {
+            if serve(r, "GET", path, "").Code == http.StatusServiceUnavailable {
+                injected++
+            }
+        }
+        return injected
+    }
+
+    // 30% of 2000 is 600, with a standard deviation of about 20.
+    if n := count(chaosConfig{ErrorRate: 0.3}, "/users"); n < 500 || n > 700 {
+        t.Errorf("injected %d of 2000 errors at a 0.3 rate", n)
+    }
+    if n := count(chaosConfig{}, "/users"); n != 0 {
+        t.Errorf("injected %d errors at a 0 rate", n)
+    }
+    if n := count(chaosConfig{ErrorRate: 1, Routes: routeSet("/users")}, "/readyz"); n != 0 {
+        t.Errorf("injected %d errors on a route not in CHAOS_ROUTES", n)
+    }
+}
+
+// useTestCipher turns on ENCRYPT_PII with a fixed key for the rest of the
+// test.
+func useTestCipher(t *testing.T) *emailCipher {
+    t.Helper()
+    e, err := newEmailCipher(bytes.Repeat([]byte{7}, 32))
+    if err != nil {
+        t.Fatal(err)
+    }
+    setGlobal(t, &piiCipher, e)
+    return e
+}
+
+func TestEmailEncryptionRoundTrip(t *testing.T) {
+    e := useTestCipher(t)
+    sealed, err := e.encrypt("john@example.com")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if strings.Contains(sealed, "john") {
+        t.Errorf("ciphertext %q leaks the address", sealed)
+    }
+    if again, _ := e.encrypt("john@example.com"); again == sealed {
+        t.Error("encrypting twice gave the same ciphertext")
+    }
+    if plain, err := e.decrypt(sealed); err != nil || plain != "john@example.com" {
+        t.Errorf("decrypt = %q, %v", plain, err)
+    }
+    if e.hash(" John@Example.com") != e.hash("john@example.com") {
+        t.Error("hash doesn't normalize case and surrounding space")
+    }
+}
+
+func TestEmailLookupByHash(t *testing.T) {
+    e := useTestCipher(t)
+    mock := mockDB(t)
+    sealed, _ := e.encrypt("john@example.com")
+    r := gin.New()
+    r.GET("/users", getUsers)
+
+    mock.ExpectQuery(regexp.QuoteMeta("email_hash = ?")).
+        WithArgs(e.hash("john@example.com")).
+        WillReturnRows(userRows(User{ID: "1", Name: "John Doe", Email: sealed}))
+    w := serve(r, "GET", "/users?email=John@Example.com", "")
+    if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"email":"john@example.com"`) {
+        t.Errorf("status %d, body %s", w.Code, w.Body)
+    }
+}
+
+func TestEncryptPlaintextEmails(t *testing.T) {
+    e := useTestCipher(t)
+    mock := mockDB(t)
+    setGlobal(t, &backfillBatchSize, 2)
+
+    // A full batch and then a short one of rows written before encryption
+    // was turned on; row 3 is converted by another instance in between.
+    for _, batch := range [][]string{{"1", "2"}, {"3"}} {
+        rows := sqlmock.NewRows([]string{"id", "email"})
+        for _, id := range batch {
+            rows.AddRow(id, "user"+id+"@example.com")
+        }
+        mock.ExpectQuery(regexp.QuoteMeta("SELECT id, email FROM users WHERE email_hash IS NULL LIMIT ?")).WithArgs(2).WillReturnRows(rows)
+        for _, id := range batch {
+            affected := int64(1)
+            if id == "3" {
+                affected = 0
+            }
+            mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET email = ?, email_hash = ? WHERE id = ? AND email_hash IS NULL")).
+                WithArgs(sealedEmail{e, "user" + id + "@example.com"}, e.hash("user"+id+"@example.com"), id).
+                WillReturnResult(sqlmock.NewResult(0, affected))
+        }
+    }
+    n, err := encryptPlaintextEmails()
+    if err != nil || n != 2 {
+        t.Errorf("encryptPlaintextEmails = %d, %v; want 2", n, err)
+    }
+}
+
+// sealedEmail matches an argument that decrypts to plain.
+type sealedEmail struct {
+    e     *emailCipher
+    plain string
+}
+
+func (s sealedEmail) Match(v driver.Value) bool {
+    stored, ok := v.(string)
+    if !ok {
+        return false
+    }
+    plain, err := s.e.decrypt(stored)
+    return err == nil && plain == s.plain
+}
+
+func TestMigrateAppliesOnlyPendingMigrations(t *testing.T) {
+    mock := mockDB(t)
+    current := len(migrations) - 2
+    mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(version), 0) FROM schema_migrations")).
+        WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(current))
+    for version := current + 1; version <= len(migrations); version++ {
+        mock.ExpectExec(regexp.QuoteMeta(migrations[version-1])).WillReturnResult(sqlmock.NewResult(0, 0))
+        mock.ExpectExec(regexp.QuoteMeta("INSERT INTO schema_migrations (version) VALUES (?)")).WithArgs(version).WillReturnResult(sqlmock.NewResult(0, 1))
+    }
+    if applied, err := migrate(); err != nil || applied != 2 {
+        t.Errorf("migrate() = %d, %v; want 2 applied", applied, err)
+    }
+}
+
+func TestGzipHonoursIdentity(t *testing.T) {
+    r := gin.New()
+    r.Use(gzipResponses())
+    r.GET("/users", func(c *gin.Context) { c.String(http.StatusOK, strings.Repeat("users ", 100)) })
+
+    for _, ae := range []string{"identity", "gzip;q=0, identity", "gzip;q=0.5, identity"} {
+        w := serve(r, "GET", "/users", "", "Accept-Encoding", ae)
+        if w.Header().Get("Content-Encoding") != "" || !strings.HasPrefix(w.Body.String(), "users ") {
+            t.Errorf("Accept-Encoding %q: Content-Encoding %q", ae, w.Header().Get("Content-Encoding"))
+        }
+    }
+
+    w := serve(r, "GET", "/users", "", "Accept-Encoding", "gzip, identity;q=0.5")
+    if w.Header().Get("Content-Encoding") != "gzip" {
+        t.Fatalf("gzip preferred: Content-Encoding %q", w.Header().Get("Content-Encoding"))
+    }
+    zr, err := gzip.NewReader(w.Body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if body, err := io.ReadAll(zr); err != nil || string(body) != strings.Repeat("users ", 100) {
+        t.Errorf("gunzipped body = %q, %v", body, err)
+    }
+}
+
+func TestBulkUpdateNeedsAdminAndReportsAffected(t *testing.T) {
+    mock := mockDB(t)
+    r, _ := newRouter(false, testAPIKeys)
+    body := `{"filter":{"email_domain":"example.com"},"set":{"name":"Renamed"}}`
+
+    if w := serve(r, "POST", "/api/v1/users/bulk-update", body, "X-API-Key", "write-key"); w.Code != http.StatusForbidden {
+        t.Errorf("users:write key: status = %d, want 403", w.Code)
+    }
+
+    // Only live users in the domain are selected, so the rest are untouched.
+    mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET name = ? WHERE email LIKE ? AND deleted_at IS NULL")).
+        WithArgs("Renamed", "%@example.com").
+        WillReturnResult(sqlmock.NewResult(0, 2))
+    w := serve(r, "POST", "/api/v1/users/bulk-update", body, "X-API-Key", "admin-key")
+    if w.Code != http.StatusOK || w.Body.String() != `{"affected":2}` {
+        t.Errorf("users:admin key: status %d, body %s", w.Code, w.Body)
+    }
+
+    if w := serve(r, "POST", "/api/v1/users/bulk-update", `{"filter":{},"set":{"name":"Renamed"}}`, "X-API-Key", "admin-key"); w.Code != http.StatusBadRequest {
+        t.Errorf("empty filter: status = %d, want 400", w.Code)
+    }
+}
+
+func TestHeadListHasCountAndNoBody(t *testing.T) {
+    mock := mockDB(t)
+    r := gin.New()
+    r.HEAD("/users", headUsers)
+
+    // Only the count runs; the page query isn't expected.
+    mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM users WHERE deleted_at IS NULL")).
+        WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(42))
+    w := serve(r, "HEAD", "/users?limit=10", "")
+    if w.Code != http.StatusOK || w.Header().Get("X-Total-Count") != "42" {
+        t.Errorf("status %d, X-Total-Count %q", w.Code, w.Header().Get("X-Total-Count"))
+    }
+    if w.Body.Len() != 0 {
+        t.Errorf("HEAD body = %q, want empty", w.Body)
+    }
+    if !strings.Contains(w.Header().Get("Link"), `rel="last"`) {
+        t.Errorf("Link = %q, want a last page", w.Header().Get("Link"))
+    }
+}
+
+func TestDeprecationWarnings(t *testing.T) {
+    mock := mockDB(t)
+    withConfig(t, func(cfg *runtimeConfig) {
+        cfg.Deprecations = []deprecation{{Field: "meta.offset", Message: "page with the Link header instead"}}
+    })
+    r := gin.New()
+    r.Use(deprecationWarnings())
+    r.GET("/users", getUsers)
+
+    mock.ExpectQuery("FROM users").WillReturnRows(userRows(exportedUsers...))
+    w := serve(r, "GET", "/users", "")
+    if got, want := w.Header().Get("Warning"), `299 - "Deprecated field meta.offset: page with the Link header instead"`; got != want {
+        t.Errorf("Warning = %q, want %q", got, want)
+    }
+    if !strings.Contains(w.Body.String(), `"deprecations":[{"field":"meta.offset","message":"page with the Link header instead"}]`) {
+        t.Errorf("body %s lacks meta.deprecations", w.Body)
+    }
+}
+
+func TestPoolHealthWarnings(t *testing.T) {
+    cfg := poolHealthConfig{Interval: time.Second, WaitCountIncrease: 5, InUseRatio: 0.9}
+    logs := captureLogs(t)
+
+    checkPoolStats(sql.DBStats{WaitCount: 10}, sql.DBStats{WaitCount: 14, MaxOpenConnections: 10, InUse: 5}, cfg)
+    if logs.Len() != 0 {
+        t.Errorf("warned below the thresholds: %s", logs)
+    }
+
+    checkPoolStats(sql.DBStats{WaitCount: 10}, sql.DBStats{WaitCount: 15, MaxOpenConnections: 10, InUse: 9}, cfg)
+    for _, msg := range []string{"callers waited for a database connection", "database connection pool nearly exhausted"} {
+        if !strings.Contains(logs.String(), msg) {
+            t.Errorf("no %q warning: %s", msg, logs)
+        }
+    }
+}
+
+func TestMonitorPoolDisabledByNonPositiveInterval(t *testing.T) {
+    mockDB(t)
+    for _, interval := range []time.Duration{0, -time.Second} {
+        done := make(chan struct{})
+        go func() {
+            defer close(done)
+            monitorPool(context.Background(), poolHealthConfig{Interval: interval})
+        }()
+        select {
+        case <-done:
+        case <-time.After(time.Second):
+            t.Errorf("monitorPool with interval %v didn't return", interval)
+        }
+    }
+}
+
+func TestProblemDetailsErrors(t *testing.T) {
+    setGlobal(t, &problemErrors, true)
+    mockDB(t)
+    r := gin.New()
+    r.GET("/users/:id", getUser)
+    r.POST("/users", createUser)
+
+    w := serve(r, "GET", "/users/abc", "")
+    if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+        t.Errorf("Content-Type = %q", ct)
+    }
+    var p problem
+    if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+        t.Fatal(err)
+    }
+    want := problem{Type: "about:blank", Title: "Bad Request", Status: http.StatusBadRequest, Detail: "Invalid ID", Instance: "/users/abc"}
+    if !reflect.DeepEqual(p, want) {
+        t.Errorf("problem = %+v, want %+v", p, want)
+    }
+
+    w = serve(r, "POST", "/users", `{"email":"ann@example.com"}`)
+    p = problem{}
+    if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+        t.Fatal(err)
+    }
+    if len(p.Fields) != 1 || p.Fields[0].Field != "name" {
+        t.Errorf("validation problem fields = %+v", p.Fields)
+    }
+}
+
+func TestDeadlineWriterAbortsOnSlowReader(t *testing.T) {
+    result := make(chan error, 1)
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        out := newDeadlineWriter(w, 100*time.Millisecond)
+        defer out.Close()
+        chunk := make([]byte, 64<<10)
+        for written := 0; written < 1<<30; written += len(chunk) {
+            if _, err := out.Write(chunk); err != nil {
+                result <- err
+                return
+            }
+        }
+        result <- nil
+    }))
+    defer srv.Close()
+
+    // The client sends its request and then never reads, so once the socket
+    // buffers fill every write blocks.
+    conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: test\r\n\r\n"); err != nil {
+        t.Fatal(err)
+    }
+
+    select {
+    case err := <-result:
+        if err == nil {
+            t.Fatal("handler wrote 1 GiB to a client that doesn't read")
+        }
+    case <-time.After(10 * time.Second):
+        t.Fatal("handler still blocked on a client that doesn't read")
+    }
+}
+
+func TestIdempotentDelete(t *testing.T) {
+    mock := mockDB(t)
+    r := gin.New()
+    r.DELETE("/users/:id", deleteUser)
+    deleteStmt := regexp.QuoteMeta("UPDATE users SET deleted_at = NOW() WHERE id = ? AND deleted_at IS NULL")
+
+    mock.ExpectExec(deleteStmt).WithArgs("404").WillReturnResult(sqlmock.NewResult(0, 0))
+    if w := serve(r, "DELETE", "/users/404", ""); w.Code != http.StatusNotFound {
+        t.Errorf("missing user: status = %d, want 404", w.Code)
+    }
+    mock.ExpectExec(deleteStmt).WithArgs("404").WillReturnResult(sqlmock.NewResult(0, 0))
+    if w := serve(r, "DELETE", "/users/404?idempotent=true", ""); w.Code != http.StatusNoContent {
+        t.Errorf("missing user with idempotent=true: status = %d, want 204", w.Code)
+    }
+}
+
+// holdingRouter serves GET /stream through limit, holding each request
+// until release is closed or its client goes away. Every request that gets
+// through signals on entered.
+func holdingRouter(limit gin.HandlerFunc, entered chan<- struct{}, release <-chan struct{}) *gin.Engine {
+    r := gin.New()
+    r.GET("/stream", limit, func(c *gin.Context) {
+        entered <- struct{}{}
+        select {
+        case <-release:
+        case <-c.Request.Context().Done():
+        }
+        c.Status(http.StatusOK)
+    })
+    return r
+}
+
+func TestStreamLimitRejectsExcess(t *testing.T) {
+    entered := make(chan struct{}, 10)
+    release := make(chan struct{})
+    r := holdingRouter(limitConcurrent(2, false, "Too many concurrent streams"), entered, release)
+
+    ctx, disconnect := context.WithCancel(context.Background())
+    disconnected := make(chan struct{})
+    go func() {
+        defer close(disconnected)
+        r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/stream", nil).WithContext(ctx))
+    }()
+    <-entered
+    var wg sync.WaitGroup
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        serve(r, "GET", "/stream", "")
+    }()
+    <-entered
+
+    if w := serve(r, "GET", "/stream", ""); w.Code != http.StatusServiceUnavailable {
+        t.Errorf("third stream: status = %d, want 503", w.Code)
+    }
+
+    // A client that disconnects gives its slot back.
+    disconnect()
+    <-disconnected
+    done := make(chan int)
+    go func() { done <- serve(r, "GET", "/stream", "").Code }()
+    select {
+    case <-entered:
+    case code := <-done:
+        t.Fatalf("stream after a disconnect: status = %d, want it admitted", code)
+    }
+    close(release)
+    <-done
+    wg.Wait()
+}
+
+func TestMultibyteNameOverColumnBytesIs422(t *testing.T) {
+    mock := mockDB(t)
+    setGlobal(t, &nameMaxBytes, 0)
+    setGlobal(t, &emailMaxBytes, 0)
+
+    // A latin1 table, as on a default MariaDB install.
+    mock.ExpectQuery("SELECT COLUMN_NAME, CHARACTER_OCTET_LENGTH FROM information_schema.COLUMNS").
+        WillReturnRows(sqlmock.NewRows([]string{"COLUMN_NAME", "CHARACTER_OCTET_LENGTH"}).AddRow("name", 100).AddRow("email", 255))
+    if err := loadColumnByteLimits(); err != nil {
+        t.Fatal(err)
+    }
+    if nameMaxBytes != 100 || emailMaxBytes != 255 {
+        t.Fatalf("limits = %d, %d; want 100, 255", nameMaxBytes, emailMaxBytes)
+    }
+
+    r := gin.New()
+    r.POST("/users", createUser)
+    // 60 characters pass the 100-character binding but take 120 bytes.
+    name := strings.Repeat("é", 60)
+    w := serve(r, "POST", "/users", `{"name":"`+name+`","email":"ann@example.com"}`)
+    if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), `"field":"name","message":"must be at most 100 bytes"`) {
+        t.Errorf("status %d, body %s", w.Code, w.Body)
+    }
+
+    mock.ExpectExec("INSERT INTO users").WillReturnResult(sqlmock.NewResult(1, 1))
+    if w := serve(r, "POST", "/users", `{"name":"`+strings.Repeat("e", 100)+`","email":"ann@example.com"}`); w.Code != http.StatusCreated {
+        t.Errorf("100 ASCII characters: status = %d, body %s", w.Code, w.Body)
+    }
+}
+
+func TestDeletedUsersListsOnlySoftDeleted(t *testing.T) {
+    mock := mockDB(t)
+    r, _ := newRouter(false, testAPIKeys)
+    deletedAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+    if w := serve(r, "GET", "/api/v1/users/deleted", "", "X-API-Key", "write-key"); w.Code != http.StatusForbidden {
+        t.Errorf("users:write key: status = %d, want 403", w.Code)
+    }
+
+    mock.ExpectQuery(regexp.QuoteMeta("FROM users WHERE deleted_at IS NOT NULL")).
+        WillReturnRows(userRows(User{ID: "3", Name: "Gone", Email: "gone@example.com", DeletedAt: &deletedAt}))
+    w := serve(r, "GET", "/api/v1/users/deleted?limit=10", "", "X-API-Key", "admin-key")
+    if w.Code != http.StatusOK {
+        t.Fatalf("status = %d, body %s", w.Code, w.Body)
+    }
+    var page struct {
+        Data []User `json:"data"`
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+        t.Fatal(err)
+    }
+    if len(page.Data) != 1 {
+        t.Fatalf("got %d users, want 1: %s", len(page.Data), w.Body)
+    }
+    got := page.Data[0]
+    if got.DeletedAt == nil || !got.DeletedAt.Equal(deletedAt) || got.IsDeleted == nil || !*got.IsDeleted {
+        t.Errorf("user = %+v, want deleted_at %v and is_deleted", got, deletedAt)
+    }
+}
+
+func TestParseRetention(t *testing.T) {
+    for in, want := range map[string]time.Duration{"30d": 30 * 24 * time.Hour, "12h": 12 * time.Hour, "90m": 90 * time.Minute} {
+        if got, err := parseRetention(in); err != nil || got != want {
+            t.Errorf("parseRetention(%q) = %v, %v; want %v", in, got, err, want)
+        }
+    }
+    for _, in := range []string{"", "0d", "-1d", "-5h", "xd", "30 days", "1e9d"} {
+        if _, err := parseRetention(in); err == nil {
+            t.Errorf("parseRetention(%q) succeeded", in)
+        }
+    }
+}
+
+func TestPurgeRemovesOnlyOldSoftDeletedUsers(t *testing.T) {
+    mock := mockDB(t)
+    r, _ := newRouter(false, testAPIKeys)
+
+    // The cutoff is passed in seconds; a full batch means another may follow.
+    purge := regexp.QuoteMeta("DELETE FROM users WHERE deleted_at IS NOT NULL AND deleted_at < NOW() - INTERVAL ? SECOND LIMIT ?")
+    mock.ExpectExec(purge).WithArgs(int64(30*24*3600), purgeBatchSize).WillReturnResult(sqlmock.NewResult(0, purgeBatchSize))
+    mock.ExpectExec(purge).WithArgs(int64(30*24*3600), purgeBatchSize).WillReturnResult(sqlmock.NewResult(0, 3))
+    w := serve(r, "DELETE", "/api/v1/users/deleted?older_than=30d", "", "X-API-Key", "admin-key")
+    if w.Code != http.StatusOK || w.Body.String() != `{"purged":1003}` {
+        t.Errorf("status %d, body %s", w.Code, w.Body)
+    }
+
+    if w := serve(r, "DELETE", "/api/v1/users/deleted?older_than=soon", "", "X-API-Key", "admin-key"); w.Code != http.StatusBadRequest {
+        t.Errorf("bad duration: status = %d, want 400", w.Code)
+    }
+    if w := serve(r, "DELETE", "/api/v1/users/deleted?older_than=30d", "", "X-API-Key", "write-key"); w.Code != http.StatusForbidden {
+        t.Errorf("users:write key: status = %d, want 403", w.Code)
+    }
+}
+
+func TestCombinedLogLineLayout(t *testing.T) {
+    req := httptest.NewRequest("GET", "/api/v1/users?limit=5", nil)
+    req.Header.Set("Referer", "https://example.com/app")
+    req.Header.Set("User-Agent", "curl/8.0")
+    p := gin.LogFormatterParams{
+        Request:    req,
+        TimeStamp:  time.Date(2024, 3, 1, 12, 30, 45, 0, time.FixedZone("", -5*3600)),
+        StatusCode: 200,
+        ClientIP:   "203.0.113.7",
+        Method:     "GET",
+        Path:       "/api/v1/users?limit=5",
+        BodySize:   512,
+        Keys:       map[any]any{actorKey: "alice"},
+    }
+    want := `203.0.113.7 - alice [01/Mar/2024:12:30:45 -0500] "GET /api/v1/users?limit=5 HTTP/1.1" 200 512 "https://example.com/app" "curl/8.0"` + "\n"
+    if got := combinedLogLine(p); got != want {
+        t.Errorf("combined line:\n got %q\nwant %q", got, want)
+    }
+
+    // Missing values are dashes, and an empty body has no size.
+    req.Header.Del("Referer")
+    req.Header.Del("User-Agent")
+    p.BodySize, p.Keys = 0, nil
+    want = `203.0.113.7 - - [01/Mar/2024:12:30:45 -0500] "GET /api/v1/users?limit=5 HTTP/1.1" 200 - "-" "-"` + "\n"
+    if got := combinedLogLine(p); got != want {
+        t.Errorf("combined line without optional fields:\n got %q\nwant %q", got, want)
+    }
+    if got, want := commonLogLine(p), `203.0.113.7 - - [01/Mar/2024:12:30:45 -0500] "GET /api/v1/users?limit=5 HTTP/1.1" 200 -`+"\n"; got != want {
+        t.Errorf("common line:\n got %q\nwant %q", got, want)
+    }
+}
+
+func TestLogFormatSelectsAccessLog(t *testing.T) {
+    mockDB(t)
+    var buf bytes.Buffer
+    setGlobal[io.Writer](t, &gin.DefaultWriter, &buf)
+    t.Setenv("LOG_FORMAT", "combined")
+    r, _ := newRouter(false, nil)
+
+    serve(r, "GET", "/nowhere", "", "User-Agent", "probe/1.0")
+    combined := regexp.MustCompile(`^\S+ - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [-+]\d{4}\] "GET /nowhere HTTP/1\.1" 404 \S+ "-" "probe/1\.0"\n$`)
+    if !combined.MatchString(buf.String()) {
+        t.Errorf("access log = %q, want a combined-format line", buf.String())
+    }
+}
+
+func TestDuplicateSlashesReachUsersHandler(t *testing.T) {
+    mock := mockDB(t)
+    r, _ := newRouter(false, nil)
+    for _, path := range []string{"/api/v1//users", "/api//v1/users", "//api/v1/users"} {
+        mock.ExpectQuery("FROM users").WillReturnRows(userRows(exportedUsers...))
+        w := serve(r, "GET", path, "")
+        if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "john@example.com") {
+            t.Errorf("%s: status %d, body %s", path, w.Code, w.Body)
+        }
+    }
+}
+
+func TestMissingAcceptUsesDefaultFormat(t *testing.T) {
+    mock := mockDB(t)
+    setGlobal(t, &exportDefaultFormat, "jsonl")
+    for _, accept := range []string{"", "*/*", "application/xml, */*;q=0.1"} {
+        expectExportModTime(mock)
+        mock.ExpectQuery("FROM users").WillReturnRows(userRows(exportedUsers...))
+        w := serve(exportRouter(), "GET", "/users/export", "", "Accept", accept)
+        if ct := w.Header().Get("Content-Type"); w.Code != http.StatusOK || ct != "application/x-ndjson" {
+            t.Errorf("Accept %q: status %d, Content-Type %q", accept, w.Code, ct)
+        }
+        if !json.Valid(bytes.SplitN(w.Body.Bytes(), []byte("\n"), 2)[0]) {
+            t.Errorf("Accept %q: body %q is not JSON lines", accept, w.Body)
+        }
+    }
+    if w := serve(exportRouter(), "GET", "/users/export", "", "Accept", "application/xml"); w.Code != http.StatusNotAcceptable {
+        t.Errorf("Accept application/xml: status = %d, want 406", w.Code)
+    }
+
+    // Lists answer a client without Accept in JSON.
+    r := gin.New()
+    r.GET("/users", getUsers)
+    mock.ExpectQuery("FROM users").WillReturnRows(userRows(exportedUsers...))
+    w := serve(r, "GET", "/users", "")
+    if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") || !json.Valid(w.Body.Bytes()) {
+        t.Errorf("list: Content-Type %q, body %s", ct, w.Body)
+    }
+}
+
+func TestBackfillUpdatesOnlyNullRowsInBatches(t *testing.T) {
+    mock := mockDB(t)
+    r, _ := newRouter(false, testAPIKeys)
+    backfill := regexp.QuoteMeta("UPDATE users SET created_by = ? WHERE created_by IS NULL LIMIT ?")
+
+    // A short batch means no NULL rows are left.
+    mock.ExpectExec(backfill).WithArgs("import", 2).WillReturnResult(sqlmock.NewResult(0, 2))
+    mock.ExpectExec(backfill).WithArgs("import", 2).WillReturnResult(sqlmock.NewResult(0, 1))
+    w := serve(r, "POST", "/api/v1/users/backfill", `{"field":"created_by","value":"import","batch_size":2}`, "X-API-Key", "admin-key")
+    if w.Code != http.StatusOK || w.Body.String() != `{"batches":2,"field":"created_by","updated":3}` {
+        t.Errorf("status %d, body %s", w.Code, w.Body)
+    }
+
+    setGlobal(t, &backfillBatchSize, 5)
+    mock.ExpectExec(backfill).WithArgs("import", 5).WillReturnResult(sqlmock.NewResult(0, 0))
+    if w := serve(r, "POST", "/api/v1/users/backfill", `{"field":"created_by","value":"import"}`, "X-API-Key", "admin-key"); w.Code != http.StatusOK {
+        t.Errorf("default batch size: status %d, body %s", w.Code, w.Body)
+    }
+
+    for _, body := range []string{
+        `{"field":"email","value":"x@example.com"}`,
+        `{"field":"created_by","value":"import","batch_size":-1}`,
+    } {
+        if w := serve(r, "POST", "/api/v1/users/backfill", body, "X-API-Key", "admin-key"); w.Code/100 != 4 {
+            t.Errorf("%s: status = %d, want a client error", body, w.Code)
+        }
+    }
+}
+
+func TestSecurityHeadersUseConfiguredValues(t *testing.T) {
+    t.Setenv("X_FRAME_OPTIONS", "SAMEORIGIN")
+    t.Setenv("CONTENT_SECURITY_POLICY", "default-src 'none'")
+    t.Setenv("STRICT_TRANSPORT_SECURITY", "max-age=600")
+    t.Setenv("X_CONTENT_TYPE_OPTIONS", "")
+    r := gin.New()
+    r.Use(securityHeaders(loadSecurityHeaders()))
+    r.GET("/ping", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+    w := serve(r, "GET", "/ping", "")
+    for name, want := range map[string]string{
+        "X-Frame-Options":           "SAMEORIGIN",
+        "Content-Security-Policy":   "default-src 'none'",
+        "Strict-Transport-Security": "", // plain HTTP
+        "X-Content-Type-Options":    "", // disabled by the empty value
+    } {
+        if got := w.Header().Get(name); got != want {
+            t.Errorf("over HTTP, %s = %q, want %q", name, got, want)
+        }
+    }
+
+    req := httptest.NewRequest("GET", "https://api.example.com/ping", nil)
+    w = httptest.NewRecorder()
+    r.ServeHTTP(w, req)
+    if got := w.Header().Get("Strict-Transport-Security"); got != "max-age=600" {
+        t.Errorf("over HTTPS, Strict-Transport-Security = %q", got)
+    }
+}
+
+func TestRateLimitStatusReflectsConsumption(t *testing.T) {
+    mock := mockDB(t)
+    t.Setenv("RATE_LIMIT_RPS", "0.001")
+    t.Setenv("RATE_LIMIT_BURST", "3")
+    r, _ := newRouter(false, testAPIKeys)
+    status := func() rateLimitStatus {
+        t.Helper()
+        w := serve(r, "GET", "/api/v1/ratelimit", "", "X-API-Key", "read-key")
+        var st rateLimitStatus
+        if err := json.Unmarshal(w.Body.Bytes(), &st); w.Code != http.StatusOK || err != nil {
+            t.Fatalf("status %d, body %s", w.Code, w.Body)
+        }
+        return st
+    }
+
+    if st := status(); st.Limit != 3 || st.Remaining != 3 {
+        t.Errorf("before any request: %+v", st)
+    }
+    for range 2 {
+        mock.ExpectQuery("FROM users").WillReturnRows(userRows(exportedUsers...))
+        serve(r, "GET", "/api/v1/users", "", "X-API-Key", "read-key")
+    }
+    // Checking twice shows the status doesn't spend a token itself.
+    for range 2 {
+        if st := status(); st.Remaining != 1 || st.Reset <= time.Now().Unix() {
+            t.Errorf("after two requests: %+v", st)
+        }
+    }
+
+    mock.ExpectQuery("FROM users").WillReturnRows(userRows(exportedUsers...))
+    if w := serve(r, "GET", "/api/v1/users", "", "X-API-Key", "read-key"); w.Code != http.StatusOK {
+        t.Errorf("last token: status = %d", w.Code)
+    }
+    if w := serve(r, "GET", "/api/v1/users", "", "X-API-Key", "read-key"); w.Code != http.StatusTooManyRequests {
+        t.Errorf("empty bucket: status = %d, want 429", w.Code)
+    }
+    if st := status(); st.Remaining != 0 {
+        t.Errorf("after the burst: %+v", st)
+    }
+}
+
+func TestReadOnlyDatabaseWriteIs503(t *testing.T) {
+    mock := mockDB(t)
+    r := gin.New()
+    r.POST("/users", createUser)
+    r.GET("/users", getUsers)
+    r.HEAD("/users", headUsers)
+
+    mock.ExpectExec("INSERT INTO users").WillReturnError(readOnlyErr())
+    w := serve(r, "POST", "/users", `{"name":"Ann","email":"ann@example.com"}`)
+    if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "database temporarily read-only") {
+        t.Errorf("status %d, body %s", w.Code, w.Body)
+    }
+    if got, want := w.Header().Get("Retry-After"), strconv.Itoa(int(dbReadOnlyRetryAfter.Seconds())); got != want {
+        t.Errorf("Retry-After = %q, want %q", got, want)
+    }
+
+    // Reads are unaffected.
+    mock.ExpectQuery("FROM users").WillReturnRows(userRows(exportedUsers...))
+    if w := serve(r, "GET", "/users", ""); w.Code != http.StatusOK {
+        t.Errorf("read: status = %d", w.Code)
+    }
+
+    // HEAD maps database errors the way GET does.
+    mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM users")).WillReturnError(readOnlyErr())
+    if w := serve(r, "HEAD", "/users", ""); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+        t.Errorf("HEAD: status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+    }
+    mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM users")).WillReturnError(sql.ErrConnDone)
+    dbClosed.Store(true)
+    t.Cleanup(func() { dbClosed.Store(false) })
+    if w := serve(r, "HEAD", "/users", ""); w.Code != http.StatusServiceUnavailable {
+        t.Errorf("HEAD on a closed database: status %d", w.Code)
+    }
+}
+
+func TestExportAppliesListFilters(t *testing.T) {
+    mock := mockDB(t)
+    expectExportModTime(mock)
+    mock.ExpectQuery(regexp.QuoteMeta("FROM users WHERE deleted_at IS NULL AND (name LIKE ? OR email LIKE ?)")).
+        WithArgs("%Jane%", "%Jane%").
+        WillReturnRows(userRows(exportedUsers[1]))
+
+    w := serve(exportRouter(), "GET", "/users/export?search=Jane", "")
+    if want := "id,name,email\n2,Jane Smith,jane@example.com\n"; w.Code != http.StatusOK || w.Body.String() != want {
+        t.Errorf("status %d, body %q; want %q", w.Code, w.Body, want)
+    }
+
+    // Filters are validated as they are for lists.
+    if w := serve(exportRouter(), "GET", "/users/export?sort=password", ""); w.Code != http.StatusBadRequest {
+        t.Errorf("bad sort: status = %d, want 400", w.Code)
+    }
+}
+
+func TestEmptyIs404(t *testing.T) {
+    mock := mockDB(t)
+    r := gin.New()
+    r.GET("/users", getUsers)
+
+    mock.ExpectQuery("FROM users").WillReturnRows(userRows())
+    if w := serve(r, "GET", "/users?search=nobody&empty_is_404=true", ""); w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), `"error"`) {
+        t.Errorf("empty with toggle: status %d, body %s", w.Code, w.Body)
+    }
+
+    mock.ExpectQuery("FROM users").WillReturnRows(userRows())
+    if w := serve(r, "GET", "/users?search=nobody", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"data":[]`) {
+        t.Errorf("empty without toggle: status %d, body %s", w.Code, w.Body)
+    }
+
+    mock.ExpectQuery("FROM users").WillReturnRows(userRows(exportedUsers[0]))
+    if w := serve(r, "GET", "/users?search=John&empty_is_404=true", ""); w.Code != http.StatusOK {
+        t.Errorf("match with toggle: status %d, body %s", w.Code, w.Body)
+    }
+}
+
+func TestFieldsCountAndLengthCaps(t *testing.T) {
+    mock := mockDB(t)
+    setGlobal(t, &fieldsMaxCount, 3)
+    setGlobal(t, &fieldsMaxLength, 20)
+    r := gin.New()
+    r.GET("/users", getUsers)
+
+    if w := serve(r, "GET", "/users?fields=id,name,email,id", ""); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "at most 3 fields") {
+        t.Errorf("four fields: status %d, body %s", w.Code, w.Body)
+    }
+    if w := serve(r, "GET", "/users?fields="+strings.Repeat(",", 21), ""); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "at most 20 characters") {
+        t.Errorf("21 characters: status %d, body %s", w.Code, w.Body)
+    }
+
+    mock.ExpectQuery("FROM users").WillReturnRows(userRows(exportedUsers...))
+    if w := serve(r, "GET", "/users?fields=id,name,email", ""); w.Code != http.StatusOK {
+        t.Errorf("three fields: status %d, body %s", w.Code, w.Body)
+    }
+}
+
+func TestDefaultSortAppliesWithoutSortParam(t *testing.T) {
+    mock := mockDB(t)
+    setGlobal(t, &defaultSort, listSort{Column: "name", Desc: true})
+    r := gin.New()
+    r.GET("/users", getUsers)
+
+    // The id tiebreaker follows the configured column.
+    mock.ExpectQuery(regexp.QuoteMeta("ORDER BY name DESC, id DESC")).WillReturnRows(userRows(exportedUsers...))
+    if w := serve(r, "GET", "/users", ""); w.Code != http.StatusOK {
+        t.Errorf("status %d, body %s", w.Code, w.Body)
+    }
+
+    mock.ExpectQuery(regexp.QuoteMeta("ORDER BY id ASC")).WillReturnRows(userRows(exportedUsers...))
+    if w := serve(r, "GET", "/users?sort=id", ""); w.Code != http.StatusOK {
+        t.Errorf("explicit sort: status %d, body %s", w.Code, w.Body)
+    }
+}
+
+func TestClosedOrMissingDatabaseIs503(t *testing.T) {
+    mock := mockDB(t)
+    r, _ := newRouter(false, nil)
+
+    mock.ExpectClose()
+    closeDB()
+    t.Cleanup(func() { dbClosed.Store(false) })
+    for _, path := range []string{"/api/v1/users", "/api/v1/users/1", "/readyz"} {
+        if w := serve(r, "GET", path, ""); w.Code != http.StatusServiceUnavailable {
+            t.Errorf("closed: GET %s: status %d, body %s", path, w.Code, w.Body)
+        }
+    }
+
+    dbClosed.Store(false)
+    setGlobal(t, &db, nil)
+    if w := serve(r, "POST", "/api/v1/users", `{"name":"Ann","email":"ann@example.com"}`); w.Code != http.StatusServiceUnavailable {
+        t.Errorf("nil: POST: status %d, body %s", w.Code, w.Body)
+    }
+}
+
+func TestWaitForDBRetriesUntilReachable(t *testing.T) {
+    mdb, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer mdb.Close()
+    setGlobal(t, &db, mdb)
+    logs := captureLogs(t)
+
+    refused := errors.New("connection refused")
+    mock.ExpectPing().WillReturnError(refused)
+    mock.ExpectPing().WillReturnError(refused)
+    mock.ExpectPing()
+    if err := waitForDB(10 * time.Second); err != nil {
+        t.Fatalf("waitForDB = %v", err)
+    }
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Error(err)
+    }
+    if n := strings.Count(logs.String(), "database not ready, retrying"); n != 2 {
+        t.Errorf("logged %d retries, want 2:\n%s", n, logs)
+    }
+
+    // Past the timeout the last error is returned.
+    mock.ExpectPing().WillReturnError(refused)
+    if err := waitForDB(0); !errors.Is(err, refused) {
+        t.Errorf("waitForDB(0) = %v, want %v", err, refused)
+    }
+}
+
+func TestUsersCreatedCounter(t *testing.T) {
+    mock := mockDB(t)
+    r := gin.New()
+    r.POST("/users", createUser)
+    before := testutil.ToFloat64(usersCreated)
+
+    mock.ExpectExec("INSERT INTO users").WillReturnResult(sqlmock.NewResult(1, 1))
+    if w := serve(r, "POST", "/users", `{"name":"Ann","email":"ann@example.com"}`); w.Code != http.StatusCreated {
+        t.Fatalf("status %d, body %s", w.Code, w.Body)
+    }
+    if got := testutil.ToFloat64(usersCreated) - before; got != 1 {
+        t.Errorf("users_created_total rose by %v, want 1", got)
+    }
+
+    // A rejected body counts as a validation failure, not a creation.
+    failures := testutil.ToFloat64(validationFailures.WithLabelValues("email"))
+    serve(r, "POST", "/users", `{"name":"Ann","email":"not-an-email"}`)
+    if got := testutil.ToFloat64(usersCreated) - before; got != 1 {
+        t.Errorf("after a rejected create, users_created_total rose by %v, want 1", got)
+    }
+    if got := testutil.ToFloat64(validationFailures.WithLabelValues("email")) - failures; got != 1 {
+        t.Errorf("validation_failures_total{field=\"email\"} rose by %v, want 1", got)
+    }
+}
+
+func TestFailFastReportsQueuePositions(t *testing.T) {
+    entered := make(chan struct{}, 1)
+    release := make(chan struct{})
+    r := holdingRouter(limitConcurrent(1, false, "Too many concurrent requests"), entered, release)
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        serve(r, "GET", "/stream", "")
+    }()
+    <-entered
+
+    // Each rejected client holds its place until its Retry-After passes.
+    for want := 1; want <= 3; want++ {
+        w := serve(r, "GET", "/stream", "")
+        if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "Too many concurrent requests") {
+            t.Errorf("request %d: status %d, body %s", want, w.Code, w.Body)
+        }
+        if got := w.Header().Get("X-Queue-Position"); got != strconv.Itoa(want) {
+            t.Errorf("request %d: X-Queue-Position = %q, want %d", want, got, want)
+        }
+        if w.Header().Get("Retry-After") == "" {
+            t.Errorf("request %d: no Retry-After", want)
+        }
+    }
+    close(release)
+    <-done
+}
+
+func TestGlobalConcurrencyLimit(t *testing.T) {
+    mock := mockDB(t)
+    t.Setenv("MAX_CONCURRENT_REQUESTS", "1")
+    r, _ := newRouter(false, nil)
+
+    // The first list holds the only slot until its client goes away.
+    mock.ExpectQuery("FROM users").WillDelayFor(time.Minute).WillReturnRows(userRows())
+    ctx, disconnect := context.WithCancel(context.Background())
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/users", nil).WithContext(ctx))
+    }()
+    for deadline := time.Now().Add(5 * time.Second); db.Stats().InUse == 0; time.Sleep(time.Millisecond) {
+        if time.Now().After(deadline) {
+            t.Fatal("first request never reached the database")
+        }
+    }
+
+    if w := serve(r, "GET", "/api/v1/users/1", ""); w.Code != http.StatusServiceUnavailable || w.Header().Get("X-Queue-Position") != "1" {
+        t.Errorf("over the limit: status %d, X-Queue-Position %q", w.Code, w.Header().Get("X-Queue-Position"))
+    }
+    disconnect()
+    <-done
+}
+
+func TestTenantCannotReadAnotherTenantsUser(t *testing.T) {
+    mock := mockDB(t)
+    t.Setenv("MULTI_TENANT", "true")
+    keys := []apiKey{
+        {Name: "a", Key: "a-key", Scopes: []string{"users:read"}, Tenant: "tenant-a"},
+        {Name: "b", Key: "b-key", Scopes: []string{"users:read"}, Tenant: "tenant-b"},
+    }
+    r, _ := newRouter(false, keys)
+    get := regexp.QuoteMeta("FROM users WHERE id = ? AND deleted_at IS NULL AND tenant_id = ?")
+
+    // User 7 belongs to tenant B, so tenant A's scoped query finds nothing.
+    mock.ExpectQuery(get).WithArgs("7", "tenant-a").WillReturnError(sql.ErrNoRows)
+    if w := serve(r, "GET", "/api/v1/users/7", "", "X-API-Key", "a-key"); w.Code != http.StatusNotFound {
+        t.Errorf("tenant A: status %d, body %s", w.Code, w.Body)
+    }
+    if w := serve(r, "GET", "/api/v1/users/7", "", "X-API-Key", "a-key", "X-Tenant-ID", "tenant-b"); w.Code != http.StatusForbidden {
+        t.Errorf("tenant A claiming B: status %d, body %s", w.Code, w.Body)
+    }
+    mock.ExpectQuery(get).WithArgs("7", "tenant-b").WillReturnRows(userRows(User{ID: "7", Name: "Bea", Email: "bea@example.com"}))
+    if w := serve(r, "GET", "/api/v1/users/7", "", "X-API-Key", "b-key"); w.Code != http.StatusOK {
+        t.Errorf("tenant B: status %d, body %s", w.Code, w.Body)
+    }
+}
+
+func TestTenantHeaderNeedsOptIn(t *testing.T) {
+    if err := checkTenantPinning(nil, false); err == nil {
+        t.Error("no API keys accepted without TRUST_TENANT_HEADER")
+    }
+    if err := checkTenantPinning(testAPIKeys, false); err == nil || !strings.Contains(err.Error(), `"reader"`) {
+        t.Errorf("unpinned keys: err = %v", err)
+    }
+    if err := checkTenantPinning(nil, true); err != nil {
+        t.Errorf("trusted header: err = %v", err)
+    }
+
+    mockDB(t)
+    r := gin.New()
+    r.GET("/users/:id", resolveTenant(false), getUser)
+    if w := serve(r, "GET", "/users/7", "", "X-Tenant-ID", "tenant-b"); w.Code != http.StatusForbidden {
+        t.Errorf("untrusted header: status %d, body %s", w.Code, w.Body)
+    }
+}
+
+func TestBulkPayloadOverLimitIs413(t *testing.T) {
+    mockDB(t) // nothing reaches the database
+    setGlobal(t, &bulkMaxBodyBytes, 256)
+    r, _ := newRouter(false, nil)
+    body := `{"users":[` + strings.Repeat(`{"name":"Ann","email":"ann@example.com"},`, 10) + `{"name":"Ann","email":"ann@example.com"}]}`
+
+    if w := serve(r, "POST", "/api/v1/users/bulk", body); w.Code != http.StatusRequestEntityTooLarge {
+        t.Errorf("with Content-Length: status %d, body %s", w.Code, w.Body)
+    }
+
+    // Without a Content-Length the body is cut off while it is decoded.
+    req := httptest.NewRequest("POST", "/api/v1/users/bulk", io.MultiReader(strings.NewReader(body)))
+    req.ContentLength = -1
+    req.Header.Set("Content-Type", "application/json")
+    w := httptest.NewRecorder()
+    r.ServeHTTP(w, req)
+    if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "at most 256 bytes") {
+        t.Errorf("chunked: status %d, body %s", w.Code, w.Body)
+    }
+}
+
+func TestBulkCreateKeepsRequestOrder(t *testing.T) {
+    mock := mockDB(t)
+    r := gin.New()
+    r.POST("/users/bulk", bulkCreateUsers)
+
+    // IDs deliberately out of order, as with interleaved inserts.
+    names := []string{"Cid", "Ann", "Bob"}
+    ids := []int64{42, 7, 19}
+    mock.ExpectBegin()
+    for i, name := range names {
+        mock.ExpectExec("INSERT INTO users").WithArgs(name, strings.ToLower(name)+"@example.com", nil, nil, nil).WillReturnResult(sqlmock.NewResult(ids[i], 1))
+    }
+    mock.ExpectCommit()
+    w := serve(r, "POST", "/users/bulk", `{"users":[{"name":"Cid","email":"cid@example.com"},{"name":"Ann","email":"ann@example.com"},{"name":"Bob","email":"bob@example.com"}]}`)
+    if w.Code != http.StatusCreated {
+        t.Fatalf("status %d, body %s", w.Code, w.Body)
+    }
+    var resp struct {
+        Data []bulkCreated `json:"data"`
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+        t.Fatal(err)
+    }
+    if len(resp.Data) != len(names) {
+        t.Fatalf("got %d users, want %d", len(resp.Data), len(names))
+    }
+    for i, got := range resp.Data {
+        if got.Index != i || got.Name != names[i] || got.ID != UserID(strconv.FormatInt(ids[i], 10)) {
+            t.Errorf("data[%d] = %+v, want index %d, %s with id %d", i, got, i, names[i], ids[i])
+        }
+    }
+}
+
+func TestForwardedProtoFromTrustedProxyMakesHTTPSLinks(t *testing.T) {
+    mock := mockDB(t)
+    r := gin.New()
+    r.GET("/users", getUsers)
+    linkScheme := func() string {
+        t.Helper()
+        mock.ExpectQuery("FROM users").WillReturnRows(userRows(exportedUsers...))
+        w := serve(r, "GET", "/users?limit=1", "", "X-Forwarded-Proto", "https")
+        link := w.Header().Get("Link")
+        scheme, _, ok := strings.Cut(strings.TrimPrefix(link, "<"), "://")
+        if !ok {
+            t.Fatalf("Link = %q", link)
+        }
+        return scheme
+    }
+
+    // httptest requests come from 192.0.2.1.
+    setGlobal(t, &trustedProxies, []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")})
+    if got := linkScheme(); got != "https" {
+        t.Errorf("from a trusted proxy: links use %s, want https", got)
+    }
+    setGlobal(t, &trustedProxies, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")})
+    if got := linkScheme(); got != "http" {
+        t.Errorf("from an untrusted client: links use %s, want http", got)
+    }
+}
+
+func TestQueryGuard(t *testing.T) {
+    mock := mockDB(t)
+    setGlobal(t, &queryGuard, true)
+    r := gin.New()
+    r.GET("/users", getUsers)
+
+    for _, target := range []string{
+        "/users?sort=name",
+        "/users?sort=name&limit=10",
+        "/users?sort=name&search=a",
+        "/users?sort=name&search=smith&limit=10",
+    } {
+        if w := serve(r, "GET", target, ""); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "sorting by name needs a filter") {
+            t.Errorf("%s: status %d, body %s", target, w.Code, w.Body)
+        }
+    }
+
+    for _, target := range []string{
+        "/users?sort=name&created_by=alice",
+        "/users?sort=updated_at&search=a",
+        "/users?sort=name&ids=1,2",
+    } {
+        mock.ExpectQuery("FROM users").WillReturnRows(userRows(exportedUsers...))
+        if w := serve(r, "GET", target, ""); w.Code != http.StatusOK {
+            t.Errorf("%s: status %d, body %s", target, w.Code, w.Body)
+        }
+    }
+
+    // An unindexed default sort would fail every unfiltered list.
+    if err := checkGuardedDefaultSort(listSort{Column: "name"}); err == nil {
+        t.Error("default sort by name accepted with the guard on")
+    }
+    if err := checkGuardedDefaultSort(listSort{Column: "updated_at", Desc: true}); err != nil {
+        t.Errorf("default sort by updated_at: %v", err)
+    }
+}
+
+func TestExportRangeResumes(t *testing.T) {
+    mock := mockDB(t)
+    const full = "id,name,email\n1,John Doe,john@example.com\n2,Jane Smith,jane@example.com\n"
+    lastModified := exportedModTime.Format(http.TimeFormat)
+
+    expectExportModTime(mock)
+    mock.ExpectQuery("SELECT id, name, email, deleted_at, updated_at FROM users").WillReturnRows(userRows(exportedUsers...))
+    w := serve(exportRouter(), "GET", "/users/export", "")
+    if w.Body.String() != full || w.Header().Get("Last-Modified") != lastModified {
+        t.Fatalf("full export: body %q, Last-Modified %q", w.Body, w.Header().Get("Last-Modified"))
+    }
+
+    expectExportModTime(mock)
+    mock.ExpectQuery("SELECT id, name, email, deleted_at, updated_at FROM users").WillReturnRows(userRows(exportedUsers...))
+    w = serve(exportRouter(), "GET", "/users/export", "", "Range", "bytes=14-", "If-Range", lastModified)
+    if w.Code != http.StatusPartialContent || w.Body.String() != full[14:] {
+        t.Errorf("resumed: status %d, body %q; want 206 with %q", w.Code, w.Body, full[14:])
+    }
+    if want := fmt.Sprintf("bytes 14-%d/%d", len(full)-1, len(full)); w.Header().Get("Content-Range") != want {
+        t.Errorf("Content-Range = %q, want %q", w.Header().Get("Content-Range"), want)
+    }
+
+    // Once the data has changed, If-Range no longer matches and the whole
+    // export is sent.
+    expectExportModTimeAt(mock, exportedModTime.Add(time.Hour), exportedModTime.Add(2*time.Hour))
+    mock.ExpectQuery("SELECT id, name, email, deleted_at, updated_at FROM users").WillReturnRows(userRows(exportedUsers...))
+    w = serve(exportRouter(), "GET", "/users/export", "", "Range", "bytes=14-", "If-Range", lastModified)
+    if w.Code != http.StatusOK || w.Body.String() != full {
+        t.Errorf("changed since: status %d, body %q; want the whole export", w.Code, w.Body)
+    }
+
+    // A ranged response's ETag resumes it exactly; another export doesn't
+    // match it.
+    etag := w.Header().Get("ETag")
+    expectExportModTime(mock)
+    mock.ExpectQuery("SELECT id, name, email, deleted_at, updated_at FROM users").WillReturnRows(userRows(exportedUsers...))
+    if w := serve(exportRouter(), "GET", "/users/export", "", "Range", "bytes=14-", "If-Range", etag); w.Code != http.StatusPartialContent || w.Body.String() != full[14:] {
+        t.Errorf("resumed by ETag %q: status %d, body %q", etag, w.Code, w.Body)
+    }
+    expectExportModTime(mock)
+    mock.ExpectQuery("SELECT id, name, email, deleted_at, updated_at FROM users").WillReturnRows(userRows(exportedUsers[:1]...))
+    if w := serve(exportRouter(), "GET", "/users/export", "", "Range", "bytes=14-", "If-Range", etag); w.Code != http.StatusOK {
+        t.Errorf("changed export resumed by ETag: status %d", w.Code)
+    }
+
+    // A write under a second old may be followed by another within the
+    // same second of updated_at, so that time isn't offered for If-Range.
+    expectExportModTimeAt(mock, exportedModTime, exportedModTime.Add(500*time.Millisecond))
+    mock.ExpectQuery("SELECT id, name, email, deleted_at, updated_at FROM users").WillReturnRows(userRows(exportedUsers...))
+    if w := serve(exportRouter(), "GET", "/users/export", ""); w.Header().Get("Last-Modified") != "" {
+        t.Errorf("Last-Modified %q for a write under a second old", w.Header().Get("Last-Modified"))
+    }
+}
+
+func TestExportRangeIsNotCompressed(t *testing.T) {
+    mock := mockDB(t)
+    const full = "id,name,email\n1,John Doe,john@example.com\n2,Jane Smith,jane@example.com\n"
+    r := gin.New()
+    r.Use(gzipResponses())
+    r.GET("/users/export", exportUsers)
+
+    expectExportModTime(mock)
+    mock.ExpectQuery("SELECT id, name, email, deleted_at, updated_at FROM users").WillReturnRows(userRows(exportedUsers...))
+    w := serve(r, "GET", "/users/export", "", "Range", "bytes=14-", "Accept-Encoding", "gzip")
+    if w.Code != http.StatusPartialContent || w.Header().Get("Content-Encoding") != "" || w.Body.String() != full[14:] {
+        t.Errorf("status %d, Content-Encoding %q, body %q", w.Code, w.Header().Get("Content-Encoding"), w.Body)
+    }
+}
+
+func TestExportRangeErrorIsNotAnAttachment(t *testing.T) {
+    mock := mockDB(t)
+    expectExportModTime(mock)
+    mock.ExpectQuery("SELECT id, name, email, deleted_at, updated_at FROM users").
+        WillReturnRows(userRows(exportedUsers...).RowError(1, errors.New("connection reset")))
+    w := serve(exportRouter(), "GET", "/users/export?format=csv", "", "Range", "bytes=14-")
+    if w.Code != http.StatusInternalServerError || w.Header().Get("Content-Disposition") != "" || strings.HasPrefix(w.Header().Get("Content-Type"), "text/csv") {
+        t.Errorf("status %d, Content-Type %q, Content-Disposition %q", w.Code, w.Header().Get("Content-Type"), w.Header().Get("Content-Disposition"))
+    }
+}
+
+// expectMigrations expects migrate to find the schema up to date.
+func expectMigrations(mock sqlmock.Sqlmock) {
+    mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(version), 0) FROM schema_migrations")).
+        WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(len(migrations)))
+}
+
+func TestPrepareSchema(t *testing.T) {
+    mock := mockDB(t)
+    for _, tc := range []struct {
+        readOnly, migrateOnly bool
+        migrates, serve       bool
+    }{
+        {readOnly: false, migrateOnly: false, migrates: true, serve: true},
+        {readOnly: true, migrateOnly: false, migrates: false, serve: true},
+        // MODE=migrate on a READ_ONLY deployment still migrates, then stops
+        // before the server is started.
+        {readOnly: true, migrateOnly: true, migrates: true, serve: false},
+        {readOnly: false, migrateOnly: true, migrates: true, serve: false},
+    } {
+        if tc.migrates {
+            expectMigrations(mock)
+        }
+        serve, err := prepareSchema(tc.readOnly, tc.migrateOnly)
+        if err != nil || serve != tc.serve {
+            t.Errorf("readOnly=%v migrateOnly=%v: serve = %v, %v; want %v", tc.readOnly, tc.migrateOnly, serve, err, tc.serve)
+        }
+        if err := mock.ExpectationsWereMet(); err != nil {
+            t.Errorf("readOnly=%v migrateOnly=%v: %v", tc.readOnly, tc.migrateOnly, err)
+        }
+    }
+}
 
-    dbURI := fmt.Sprintf("%s:%s@tcp(%s:3306)/%s?parseTime=true", dbUser, dbPassword, dbHost, dbName)
+func TestReadOnlyRejectsWrites(t *testing.T) {
+    mock := mockDB(t)
+    r, _ := newRouter(true, nil)
+    for _, method := range []string{"POST", "PUT", "PATCH", "DELETE"} {
+        w := serve(r, method, "/api/v1/users/1", `{"name":"Ann","email":"ann@example.com"}`)
+        if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, HEAD, OPTIONS" {
+            t.Errorf("%s: status %d, Allow %q", method, w.Code, w.Header().Get("Allow"))
+        }
+    }
+    if w := serve(r, "POST", "/api/v1/users", `{"name":"Ann","email":"ann@example.com"}`); w.Code != http.StatusMethodNotAllowed {
+        t.Errorf("POST /users: status = %d, want 405", w.Code)
+    }
 
-    var err error
-    db, err = sql.Open("mysql", dbURI)
-    if err != nil {
-        log.Fatal(err)
+    mock.ExpectQuery("FROM users").WillReturnRows(userRows(exportedUsers...))
+    if w := serve(r, "GET", "/api/v1/users", ""); w.Code != http.StatusOK {
+        t.Errorf("GET: status = %d", w.Code)
     }
-    defer db.Close()
+}
 
-    r := gin.Default()
+func TestSimulatedLatency(t *testing.T) {
+    const delay = 50 * time.Millisecond
+    r := gin.New()
+    r.Use(simulateLatency(delay, routeSet("/slow")))
+    r.GET("/slow", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+    r.GET("/fast", func(c *gin.Context) { c.Status(http.StatusNoContent) })
 
-    v1 := r.Group("/api/v1")
-    {
-        users := v1.Group("/users")
-        {
-            users.GET("", getUsers)
-            users.GET("/:id", getUser)
-            users.POST("", createUser)
-            users.PUT("/:id", updateUser)
-            users.DELETE("/:id", deleteUser)
+    start := time.Now()
+    if w := serve(r, "GET", "/slow", ""); w.Code != http.StatusNoContent || time.Since(start) < delay {
+        t.Errorf("delayed route: status %d after %v", w.Code, time.Since(start))
+    }
+    start = time.Now()
+    if serve(r, "GET", "/fast", ""); time.Since(start) >= delay {
+        t.Errorf("other route took %v", time.Since(start))
+    }
+
+    // A client that gives up isn't kept waiting or handled.
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+    defer cancel()
+    slow := gin.New()
+    slow.Use(simulateLatency(time.Minute, nil))
+    handled := false
+    slow.GET("/slow", func(c *gin.Context) { handled = true })
+    start = time.Now()
+    slow.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil).WithContext(ctx))
+    if handled || time.Since(start) > time.Second {
+        t.Errorf("cancelled request: handled %v after %v", handled, time.Since(start))
+    }
+}
+
+func TestDebugOnlySettingsRefusedInRelease(t *testing.T) {
+    if err := checkDebugOnly("SIMULATE_LATENCY_MS"); err != nil {
+        t.Errorf("test mode: %v", err)
+    }
+    gin.SetMode(gin.ReleaseMode)
+    defer gin.SetMode(gin.TestMode)
+    if err := checkDebugOnly("SIMULATE_LATENCY_MS"); err == nil {
+        t.Error("release mode: SIMULATE_LATENCY_MS accepted")
+    }
+}
+
+func TestCursorSigning(t *testing.T) {
+    cursor := listCursor{Column: "name", Desc: true, Value: "Jane Smith", ID: "2"}
+    token := encodeCursor(cursor)
+    if got, err := decodeCursor(token); err != nil || got != cursor {
+        t.Fatalf("decodeCursor(encodeCursor(%+v)) = %+v, %v", cursor, got, err)
+    }
+
+    // Re-encoding an edited cursor keeps the old signature, which no longer
+    // matches.
+    _, sig, _ := strings.Cut(token, ".")
+    edited, _ := json.Marshal(listCursor{Column: "name", Desc: true, Value: "Jane Smith", ID: "1"})
+    forged := base64.RawURLEncoding.EncodeToString(edited) + "." + sig
+    for name, bad := range map[string]string{
+        "edited":    forged,
+        "unsigned":  base64.RawURLEncoding.EncodeToString(edited),
+        "truncated": token[:len(token)-2],
+        "garbage":   "not-a-cursor",
+    } {
+        if _, err := decodeCursor(bad); err == nil {
+            t.Errorf("%s cursor accepted", name)
         }
     }
 
-    r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
+    setGlobal(t, &cursorKey, cursorSigningKey("another-instance"))
+    if _, err := decodeCursor(token); err == nil {
+        t.Error("cursor signed with another key accepted")
+    }
+    if !bytes.Equal(cursorSigningKey("shared"), cursorSigningKey("shared")) {
+        t.Error("CURSOR_SECRET doesn't give the same key on every instance")
+    }
+
+    mock := mockDB(t)
+    r := gin.New()
+    r.GET("/users", getUsers)
+    if w := serve(r, "GET", "/users?limit=10&cursor="+url.QueryEscape(forged), ""); w.Code != http.StatusBadRequest {
+        t.Errorf("forged cursor: status %d, body %s", w.Code, w.Body)
+    }
 
-    r.Run(":8080")
+    // A page's next_cursor continues after its last user.
+    mock.ExpectQuery("FROM users").WillReturnRows(userRows(exportedUsers...))
+    w := serve(r, "GET", "/users?limit=2&sort=name", "")
+    var page struct {
+        Meta listMeta `json:"meta"`
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || page.Meta.NextCursor == "" {
+        t.Fatalf("first page: %s", w.Body)
+    }
+    mock.ExpectQuery(regexp.QuoteMeta("(name > ? OR (name = ? AND id > ?))")).
+        WithArgs("Jane Smith", "Jane Smith", "2").
+        WillReturnRows(userRows())
+    if w := serve(r, "GET", "/users?limit=2&cursor="+url.QueryEscape(page.Meta.NextCursor), ""); w.Code != http.StatusOK {
+        t.Errorf("next page: status %d, body %s", w.Code, w.Body)
+    }
 }
 
-// @Summary Get all users
-// @Description Get a list of all users
-// @Produce json
-// @Success 200 {array} User
-// @Router /users [get]
-func getUsers(c *gin.Context) {
-    var users []User
-    rows, err := db.Query("SELECT id, name, email FROM users")
-    if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-        return
+func TestTooManyQueryParamsIs400(t *testing.T) {
+    mock := mockDB(t)
+    t.Setenv("MAX_QUERY_PARAMS", "5")
+    r, _ := newRouter(false, nil)
+
+    if w := serve(r, "GET", "/api/v1/users?a=1&b=2&c=3&d=4&e=5&f=6", ""); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "at most 5 query parameters") {
+        t.Errorf("six parameters: status %d, body %s", w.Code, w.Body)
+    }
+    // Repeating one name counts every occurrence.
+    if w := serve(r, "GET", "/api/v1/users?"+strings.Repeat("ids=1&", 5)+"ids=1", ""); w.Code != http.StatusBadRequest {
+        t.Errorf("six repeated parameters: status %d, body %s", w.Code, w.Body)
     }
-    defer rows.Close()
 
-    for rows.Next() {
-        var user User
-        if err := rows.Scan(&user.ID, &user.Name, &user.Email); err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-            return
+    mock.ExpectQuery("FROM users").WillReturnRows(userRows(exportedUsers...))
+    if w := serve(r, "GET", "/api/v1/users?limit=10&offset=0&sort=id&search=a&with_count=false", ""); w.Code != http.StatusOK {
+        t.Errorf("five parameters: status %d, body %s", w.Code, w.Body)
+    }
+}
+
+func TestBulkRollbackNamesFailingItem(t *testing.T) {
+    mock := mockDB(t)
+    r := gin.New()
+    r.POST("/users/bulk", bulkCreateUsers)
+    body := `{"users":[{"name":"Ann","email":"ann@example.com"},{"name":"Bob","email":"bob@example.com"},{"name":"Cid","email":"cid@example.com"}]}`
+
+    mock.ExpectBegin()
+    mock.ExpectExec("INSERT INTO users").WillReturnResult(sqlmock.NewResult(1, 1))
+    mock.ExpectExec("INSERT INTO users").WillReturnError(errors.New("Duplicate entry 'bob@example.com' for key 'email'"))
+    mock.ExpectRollback()
+    w := serve(r, "POST", "/users/bulk", body)
+    if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), `"field":"users[1]","message":"Duplicate entry`) {
+        t.Errorf("insert failure: status %d, body %s", w.Code, w.Body)
+    }
+
+    // Invalid items are all reported before anything is written.
+    setGlobal(t, &nameMaxBytes, 3)
+    w = serve(r, "POST", "/users/bulk", `{"users":[{"name":"Ann","email":"ann@example.com"},{"name":"Bobby","email":"bob@example.com"},{"name":"Cidney","email":"cid@example.com"}]}`)
+    if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), `"users[1].name"`) || !strings.Contains(w.Body.String(), `"users[2].name"`) {
+        t.Errorf("validation: status %d, body %s", w.Code, w.Body)
+    }
+}
+
+func TestHealthAndMetricsPaths(t *testing.T) {
+    mockDB(t)
+    t.Setenv("HEALTH_PATH_PREFIX", "/internal/")
+    t.Setenv("METRICS_PATH", "/internal/metrics")
+    r, admin := newRouter(false, nil)
+    if admin != nil {
+        t.Fatal("admin engine built without ADMIN_LISTEN_ADDR")
+    }
+
+    if w := serve(r, "GET", "/internal/readyz", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"status":"ok"`) {
+        t.Errorf("readyz: status %d, body %s", w.Code, w.Body)
+    }
+    if w := serve(r, "GET", "/internal/metrics", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "users_created_total") {
+        t.Errorf("metrics: status %d", w.Code)
+    }
+    for _, path := range []string{"/readyz", "/metrics"} {
+        if w := serve(r, "GET", path, ""); w.Code != http.StatusNotFound {
+            t.Errorf("%s: status = %d, want 404 once relocated", path, w.Code)
         }
-        users = append(users, user)
     }
+}
+
+func TestAdminListenerServesMetrics(t *testing.T) {
+    mockDB(t)
+    t.Setenv("ADMIN_LISTEN_ADDR", ":9090")
+    api, admin := newRouter(false, nil)
+    if admin == nil {
+        t.Fatal("no admin engine with ADMIN_LISTEN_ADDR set")
+    }
+    apiServer := httptest.NewServer(api)
+    defer apiServer.Close()
+    adminServer := httptest.NewServer(admin)
+    defer adminServer.Close()
 
-    c.JSON(http.StatusOK, users)
+    status := func(base, path string) int {
+        t.Helper()
+        resp, err := http.Get(base + path)
+        if err != nil {
+            t.Fatal(err)
+        }
+        resp.Body.Close()
+        return resp.StatusCode
+    }
+    for _, path := range []string{"/metrics", "/readyz"} {
+        if code := status(adminServer.URL, path); code != http.StatusOK {
+            t.Errorf("admin %s: status = %d, want 200", path, code)
+        }
+        if code := status(apiServer.URL, path); code != http.StatusNotFound {
+            t.Errorf("api %s: status = %d, want 404", path, code)
+        }
+    }
+    if code := status(adminServer.URL, "/api/v1/users"); code != http.StatusNotFound {
+        t.Errorf("admin /api/v1/users: status = %d, want 404", code)
+    }
 }
 
-// @Summary Get a user
-// @Description Get a user by ID
-// @Produce json
-// @Param id path int true "User ID"
-// @Success 200 {object} User
-// @Router /users/{id} [get]
-func getUser(c *gin.Context) {
-    id := c.Param("id")
-    var user User
-    err := db.QueryRow("SELECT id, name, email FROM users WHERE id = ?", id).Scan(&user.ID, &user.Name, &user.Email)
-    if err != nil {
-        c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
-        return
+func TestCamelJSONNaming(t *testing.T) {
+    if got := snakeToCamel("created_at"); got != "createdAt" {
+        t.Errorf(`snakeToCamel("created_at") = %q`, got)
+    }
+
+    mock := mockDB(t)
+    r := gin.New()
+    r.GET("/users/:id", getUser)
+    updatedAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+    user := User{ID: "1", Name: "John Doe", Email: "john@example.com", UpdatedAt: &updatedAt}
+
+    mock.ExpectQuery("FROM users").WillReturnRows(userRows(user))
+    if w := serve(r, "GET", "/users/1", ""); !strings.Contains(w.Body.String(), `"updated_at":"2024-03-01T12:00:00Z"`) {
+        t.Errorf("snake: body %s", w.Body)
+    }
+
+    setGlobal(t, &camelJSON, true)
+    mock.ExpectQuery("FROM users").WillReturnRows(userRows(user))
+    w := serve(r, "GET", "/users/1", "")
+    if !strings.Contains(w.Body.String(), `"updatedAt":"2024-03-01T12:00:00Z"`) || strings.Contains(w.Body.String(), "updated_at") {
+        t.Errorf("camel: body %s", w.Body)
     }
-    c.JSON(http.StatusOK, user)
 }
 
-// @Summary Create a user
-// @Description Create a new user
-// @Accept json
-// @Produce json
-// @Param user body User true "User object"
-// @Success 201 {object} User
-// @Router /users [post]
-func createUser(c *gin.Context) {
-    var user User
-    if err := c.ShouldBindJSON(&user); err != nil {
-        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-        return
+func TestMalformedAcceptEncodingIsIdentity(t *testing.T) {
+    r := gin.New()
+    r.Use(gzipResponses())
+    r.GET("/users", func(c *gin.Context) { c.String(http.StatusOK, strings.Repeat("users ", 100)) })
+
+    for _, ae := range []string{
+        "gzip;q=abc",
+        "gzip;q=NaN",
+        "gzip;q=2",
+        "gzip;q=-1",
+        ";;;,,,=;q=",
+        "\x00\xff garbage",
+        // Only the first maxNegotiationEntries entries are considered.
+        strings.Repeat("br, ", 10000) + "gzip",
+    } {
+        w := serve(r, "GET", "/users", "", "Accept-Encoding", ae)
+        if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "" || w.Body.String() != strings.Repeat("users ", 100) {
+            t.Errorf("Accept-Encoding %.40q: status %d, Content-Encoding %q", ae, w.Code, w.Header().Get("Content-Encoding"))
+        }
     }
+}
 
-    result, err := db.Exec("INSERT INTO users (name, email) VALUES (?, ?)", user.Name, user.Email)
-    if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-        return
+func TestModifiedSince(t *testing.T) {
+    mock := mockDB(t)
+    r, _ := newRouter(false, testAPIKeys)
+    since := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+    recent := since.Add(time.Hour)
+    deletedAt := since.Add(2 * time.Hour)
+
+    mock.ExpectQuery(regexp.QuoteMeta("FROM users WHERE deleted_at IS NULL AND updated_at >= ? ORDER BY updated_at ASC, id ASC")).
+        WithArgs(since).
+        WillReturnRows(userRows(User{ID: "2", Name: "Jane Smith", Email: "jane@example.com", UpdatedAt: &recent}))
+    w := serve(r, "GET", "/api/v1/users?modified_since=2024-03-01T00:00:00Z", "", "X-API-Key", "read-key")
+    if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"id":2`) || strings.Contains(w.Body.String(), `"id":1`) {
+        t.Errorf("status %d, body %s", w.Code, w.Body)
     }
 
-    id, _ := result.LastInsertId()
-    user.ID = int(id)
-    c.JSON(http.StatusCreated, user)
+    // Deletions are propagated to admins syncing with include_deleted.
+    mock.ExpectQuery(regexp.QuoteMeta("FROM users WHERE updated_at >= ?")).
+        WithArgs(since).
+        WillReturnRows(userRows(User{ID: "3", Name: "Gone", Email: "gone@example.com", DeletedAt: &deletedAt, UpdatedAt: &deletedAt}))
+    w = serve(r, "GET", "/api/v1/users?modified_since=2024-03-01T00:00:00Z&include_deleted=true", "", "X-API-Key", "admin-key")
+    if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"is_deleted":true`) {
+        t.Errorf("include_deleted: status %d, body %s", w.Code, w.Body)
+    }
+
+    if w := serve(r, "GET", "/api/v1/users?modified_since=yesterday", "", "X-API-Key", "read-key"); w.Code != http.StatusBadRequest {
+        t.Errorf("bad time: status = %d, want 400", w.Code)
+    }
 }
 
-// @Summary Update a user
-// @Description Update a user by ID
-// @Accept json
-// @Produce json
-// @Param id path int true "User ID"
-// @Param user body User true "User object"
-// @Success 200 {object} User
-// @Router /users/{id} [put]
-func updateUser(c *gin.Context) {
-    idStr := c.Param("id")
-    id, err := strconv.Atoi(idStr)
-    if err != nil {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
-        return
+func TestIsDeletedFlag(t *testing.T) {
+    mock := mockDB(t)
+    r, _ := newRouter(false, testAPIKeys)
+    deletedAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+    mock.ExpectQuery(regexp.QuoteMeta("SELECT id, name, email, deleted_at, updated_at FROM users ORDER BY id ASC")).
+        WillReturnRows(userRows(exportedUsers[0], User{ID: "3", Name: "Gone", Email: "gone@example.com", DeletedAt: &deletedAt}))
+    w := serve(r, "GET", "/api/v1/users?include_deleted=true", "", "X-API-Key", "admin-key")
+    var page struct {
+        Data []User `json:"data"`
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || len(page.Data) != 2 {
+        t.Fatalf("status %d, body %s", w.Code, w.Body)
+    }
+    for _, user := range page.Data {
+        want := user.ID == "3"
+        if user.IsDeleted == nil || *user.IsDeleted != want {
+            t.Errorf("user %s: is_deleted = %v, want %v", user.ID, user.IsDeleted, want)
+        }
     }
 
-    var user User
-    if err := c.ShouldBindJSON(&user); err != nil {
-        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-        return
+    // Lists of live users only leave it out.
+    mock.ExpectQuery("FROM users").WillReturnRows(userRows(exportedUsers...))
+    if w := serve(r, "GET", "/api/v1/users", "", "X-API-Key", "admin-key"); strings.Contains(w.Body.String(), "is_deleted") {
+        t.Errorf("live list: body %s", w.Body)
     }
+}
 
-    _, err = db.Exec("UPDATE users SET name = ?, email = ? WHERE id = ?", user.Name, user.Email, id)
-    if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-        return
+func TestRequestIDInQueryComment(t *testing.T) {
+    mock := mockDB(t)
+    t.Setenv("DB_QUERY_COMMENTS", "true")
+    r, _ := newRouter(false, nil)
+
+    mock.ExpectQuery(regexp.QuoteMeta("/* request_id=trace-42 */ SELECT id, name, email, deleted_at, updated_at FROM users WHERE id = ?")).
+        WithArgs("1").
+        WillReturnRows(userRows(exportedUsers[0]))
+    if w := serve(r, "GET", "/api/v1/users/1", "", "X-Request-ID", "trace-42"); w.Code != http.StatusOK {
+        t.Errorf("status %d, body %s", w.Code, w.Body)
     }
 
-    user.ID = id
-    c.JSON(http.StatusOK, user)
+    // An ID that could close the comment is replaced by a generated one.
+    mock.ExpectQuery(`^/\* request_id=[0-9a-f-]{36} \*/ SELECT`).WillReturnRows(userRows(exportedUsers[0]))
+    w := serve(r, "GET", "/api/v1/users/1", "", "X-Request-ID", "x */ DROP TABLE users; /*")
+    if _, err := uuid.Parse(w.Header().Get("X-Request-ID")); err != nil {
+        t.Errorf("X-Request-ID = %q, want a generated UUID", w.Header().Get("X-Request-ID"))
+    }
 }
 
-// @Summary Delete a user
-// @Description Delete a user by ID
-// @Produce json
-// @Param id path int true "User ID"
-// @Success 204 "No Content"
-// @Router /users/{id} [delete]
-func deleteUser(c *gin.Context) {
-    id := c.Param("id")
-    _, err := db.Exec("DELETE FROM users WHERE id = ?", id)
+func TestCreateWithIDInBody(t *testing.T) {
+    mock := mockDB(t)
+    r := gin.New()
+    r.POST("/users", createUser)
+
+    // By default a client-sent id is ignored and the database assigns one.
+    mock.ExpectExec("INSERT INTO users \\(name,").WillReturnResult(sqlmock.NewResult(9, 1))
+    w := serve(r, "POST", "/users", `{"id":5,"name":"Ann","email":"ann@example.com"}`)
+    if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"id":9`) {
+        t.Errorf("ignored: status %d, body %s", w.Code, w.Body)
+    }
+
+    setGlobal(t, &strictCreate, true)
+    for _, id := range []string{`5`, `"5"`} {
+        w := serve(r, "POST", "/users", `{"id":`+id+`,"name":"Ann","email":"ann@example.com"}`)
+        if w.Code/100 != 4 || !strings.Contains(w.Body.String(), "must not be provided on create") {
+            t.Errorf("strict, id %s: status %d, body %s", id, w.Code, w.Body)
+        }
+    }
+    // An explicit null is the same as leaving it out.
+    mock.ExpectExec("INSERT INTO users").WillReturnResult(sqlmock.NewResult(10, 1))
+    if w := serve(r, "POST", "/users", `{"id":null,"name":"Ann","email":"ann@example.com"}`); w.Code != http.StatusCreated {
+        t.Errorf("strict, id null: status %d, body %s", w.Code, w.Body)
+    }
+}
+
+func TestMetaReflectsRateLimitAndFeatures(t *testing.T) {
+    mock := mockDB(t)
+    t.Setenv("RATE_LIMIT_RPS", "0.001")
+    t.Setenv("RATE_LIMIT_BURST", "5")
+    t.Setenv("GZIP_ENABLED", "true")
+    r, _ := newRouter(false, testAPIKeys)
+    meta := func() apiMeta {
+        t.Helper()
+        w := serve(r, "GET", "/api/v1/meta", "", "X-API-Key", "write-key")
+        var m apiMeta
+        if err := json.Unmarshal(w.Body.Bytes(), &m); w.Code != http.StatusOK || err != nil {
+            t.Fatalf("status %d, body %s", w.Code, w.Body)
+        }
+        return m
+    }
+
+    for range 2 {
+        mock.ExpectQuery("FROM users").WillReturnRows(userRows(exportedUsers...))
+        serve(r, "GET", "/api/v1/users", "", "X-API-Key", "write-key")
+    }
+    m := meta()
+    if m.RateLimit == nil || m.RateLimit.Limit != 5 || m.RateLimit.Remaining != 3 {
+        t.Errorf("rate_limit = %+v, want 3 of 5 remaining", m.RateLimit)
+    }
+    if strings.Join(m.Scopes, ",") != "users:read,users:write" {
+        t.Errorf("scopes = %v", m.Scopes)
+    }
+    if !m.Features.Gzip || m.Features.ReadOnly || m.Features.MaxListLimit != maxListLimit {
+        t.Errorf("features = %+v", m.Features)
+    }
+    // meta itself is free.
+    if m := meta(); m.RateLimit.Remaining != 3 {
+        t.Errorf("after a second meta call, remaining = %d", m.RateLimit.Remaining)
+    }
+}
+
+// flushRecorder records how much of the body had been written at each flush.
+type flushRecorder struct {
+    *httptest.ResponseRecorder
+    flushedAt []int
+}
+
+func (f *flushRecorder) Flush() {
+    f.flushedAt = append(f.flushedAt, f.Body.Len())
+    f.ResponseRecorder.Flush()
+}
+
+func TestStreamedListFlushesAsItGoes(t *testing.T) {
+    mock := mockDB(t)
+    setGlobal(t, &streamLists, true)
+    r := gin.New()
+    r.GET("/users", getUsers)
+
+    const n = 2*exportFlushEvery + 200
+    rows := sqlmock.NewRows([]string{"id", "name", "email", "deleted_at", "updated_at"})
+    for i := 1; i <= n; i++ {
+        rows.AddRow(strconv.Itoa(i), "User "+strconv.Itoa(i), "user"+strconv.Itoa(i)+"@example.com", nil, nil)
+    }
+    mock.ExpectQuery("FROM users").WillReturnRows(rows)
+    w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+    r.ServeHTTP(w, httptest.NewRequest("GET", "/users", nil))
+
+    var page struct {
+        Data []User `json:"data"`
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || len(page.Data) != n {
+        t.Fatalf("decoded %d users, %v", len(page.Data), err)
+    }
+    // Rows reach the client in batches rather than all at the end.
+    if len(w.flushedAt) < 3 || w.flushedAt[0] == 0 || w.flushedAt[0] >= w.Body.Len()/2 {
+        t.Errorf("flushed at %v of %d bytes", w.flushedAt, w.Body.Len())
+    }
+}
+
+func TestAuditReadsRecordsAccessor(t *testing.T) {
+    mock := mockDB(t)
+    setGlobal(t, &auditReads, true)
+    r := gin.New()
+    r.Use(actingAs("alice"))
+    r.GET("/users/:id", getUser)
+
+    mock.ExpectQuery("FROM users WHERE id = ?").WithArgs("7").
+        WillReturnRows(userRows(User{ID: "7", Name: "Ann", Email: "ann@example.com"}))
+    mock.ExpectExec("INSERT INTO user_read_audit").
+        WithArgs("7", sql.NullString{String: "alice", Valid: true}, sql.NullString{}, sqlmock.AnyArg()).
+        WillReturnResult(sqlmock.NewResult(1, 1))
+    if w := serve(r, "GET", "/users/7", ""); w.Code != http.StatusOK {
+        t.Fatalf("status %d: %s", w.Code, w.Body)
+    }
+
+    // With auditing off the read leaves no trace.
+    auditReads = false
+    mock.ExpectQuery("FROM users WHERE id = ?").WithArgs("7").
+        WillReturnRows(userRows(User{ID: "7", Name: "Ann", Email: "ann@example.com"}))
+    if w := serve(r, "GET", "/users/7", ""); w.Code != http.StatusOK {
+        t.Fatalf("status %d: %s", w.Code, w.Body)
+    }
+}
+
+func TestTenantQueryBudgetIsPerTenant(t *testing.T) {
+    entered := make(chan struct{}, 10)
+    release := make(chan struct{})
+    budget := limitTenantQueries(1, 50*time.Millisecond)
+    r := holdingRouter(func(c *gin.Context) {
+        c.Set(tenantKey, c.GetHeader("X-Tenant-ID"))
+        budget(c)
+    }, entered, release)
+    get := func(tenant string) *httptest.ResponseRecorder {
+        req := httptest.NewRequest("GET", "/stream", nil)
+        req.Header.Set("X-Tenant-ID", tenant)
+        w := httptest.NewRecorder()
+        r.ServeHTTP(w, req)
+        return w
+    }
+
+    held := make(chan *httptest.ResponseRecorder)
+    go func() { held <- get("acme") }()
+    <-entered
+
+    if w := get("acme"); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+        t.Errorf("second acme request: status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+    }
+    // globex has its own budget, so acme holding its slot doesn't block it.
+    other := make(chan *httptest.ResponseRecorder)
+    go func() { other <- get("globex") }()
+    select {
+    case <-entered:
+    case <-time.After(time.Second):
+        t.Fatal("globex request was blocked by acme")
+    }
+    close(release)
+    if w := <-other; w.Code != http.StatusOK {
+        t.Errorf("globex status %d", w.Code)
+    }
+    if w := <-held; w.Code != http.StatusOK {
+        t.Errorf("first acme request: status %d", w.Code)
+    }
+}
+
+func TestSchemaDescribesEmail(t *testing.T) {
+    r := gin.New()
+    r.GET("/schema", schemaHandler(apiSchema()))
+    w := serve(r, "GET", "/schema", "")
+    if w.Code != http.StatusOK {
+        t.Fatalf("status %d", w.Code)
+    }
+    var doc struct {
+        Version int `json:"version"`
+        Defs    struct {
+            User struct {
+                Properties map[string]map[string]any `json:"properties"`
+                Required   []string                  `json:"required"`
+            } `json:"User"`
+        } `json:"$defs"`
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+        t.Fatal(err)
+    }
+    user := doc.Defs.User
+    email := user.Properties["email"]
+    if email["type"] != "string" || email["format"] != "email" || email["maxLength"] != float64(100) {
+        t.Errorf("email schema %v", email)
+    }
+    if !slices.Contains(user.Required, "email") {
+        t.Errorf("required %v does not include email", user.Required)
+    }
+    if user.Properties["id"]["readOnly"] != true {
+        t.Errorf("id schema %v is not readOnly", user.Properties["id"])
+    }
+    if doc.Version != schemaVersion {
+        t.Errorf("version %d", doc.Version)
+    }
+}
+
+func TestUserLockRunsWriteOnLockConnection(t *testing.T) {
+    mock := mockDB(t)
+    // With a single connection, a write that asked the pool for a second
+    // one while the lock's is held would never get it.
+    db.SetMaxOpenConns(1)
+    r := gin.New()
+    r.DELETE("/users/:id", serializeUserWrites(time.Second), deleteUser)
+
+    mock.ExpectQuery(regexp.QuoteMeta("SELECT GET_LOCK(?, ?)")).WithArgs("user:7", float64(1)).
+        WillReturnRows(sqlmock.NewRows([]string{"got"}).AddRow(1))
+    mock.ExpectExec("UPDATE users SET deleted_at = NOW()").WithArgs("7").WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(regexp.QuoteMeta("DO RELEASE_LOCK(?)")).WithArgs("user:7").WillReturnResult(sqlmock.NewResult(0, 0))
+    done := make(chan *httptest.ResponseRecorder)
+    go func() { done <- serve(r, "DELETE", "/users/7", "") }()
+    select {
+    case w := <-done:
+        if w.Code != http.StatusNoContent {
+            t.Fatalf("status %d: %s", w.Code, w.Body)
+        }
+    case <-time.After(2 * time.Second):
+        t.Fatal("locked delete deadlocked on the connection pool")
+    }
+
+    // A lock another request still holds after the timeout is a conflict.
+    mock.ExpectQuery(regexp.QuoteMeta("SELECT GET_LOCK(?, ?)")).WithArgs("user:7", float64(1)).
+        WillReturnRows(sqlmock.NewRows([]string{"got"}).AddRow(0))
+    w := serve(r, "DELETE", "/users/7", "")
+    if w.Code != http.StatusConflict || w.Header().Get("Retry-After") == "" {
+        t.Errorf("status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+    }
+}
+
+func TestListEnvelopeToggle(t *testing.T) {
+    mock := mockDB(t)
+    r := gin.New()
+    r.GET("/users", getUsers)
+    ann := User{ID: "1", Name: "Ann", Email: "ann@example.com"}
+
+    mock.ExpectQuery("FROM users").WillReturnRows(userRows(ann))
+    w := serve(r, "GET", "/users?limit=1", "")
+    var page struct {
+        Data []User         `json:"data"`
+        Meta map[string]any `json:"meta"`
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || len(page.Data) != 1 || page.Meta["limit"] != float64(1) {
+        t.Fatalf("default list is not enveloped: %v %s", err, w.Body)
+    }
+
+    for name, header := range map[string][]string{
+        "envelope=false": nil,
+        "profile=bare":   {"Accept", "application/json; profile=bare"},
+    } {
+        target := "/users?limit=1"
+        if header == nil {
+            target += "&envelope=false"
+        }
+        mock.ExpectQuery("FROM users").WillReturnRows(userRows(ann))
+        w := serve(r, "GET", target, "", header...)
+        var users []User
+        if err := json.Unmarshal(w.Body.Bytes(), &users); err != nil || len(users) != 1 || users[0].Name != "Ann" {
+            t.Errorf("%s: not a bare array: %v %s", name, err, w.Body)
+        }
+        if w.Header().Get("X-Next-Cursor") == "" {
+            t.Errorf("%s: paging missing from headers", name)
+        }
+    }
+}
+
+func TestPoolChurnIsLogged(t *testing.T) {
+    logs := captureLogs(t)
+    prev := sql.DBStats{OpenConnections: 4, Idle: 2, MaxLifetimeClosed: 10}
+    logPoolChurn(prev, prev)
+    if logs.Len() != 0 {
+        t.Fatalf("steady pool logged %q", logs)
+    }
+
+    // Two connections hit their lifetime and one its idle timeout; the pool
+    // grew by one, so four were opened.
+    cur := sql.DBStats{OpenConnections: 5, Idle: 1, MaxLifetimeClosed: 12, MaxIdleTimeClosed: 1}
+    logPoolChurn(prev, cur)
+    out := logs.String()
+    for _, want := range []string{"level=DEBUG", "opened=4", "closed_lifetime=2", "closed_idle_time=1", "closed_max_idle=0", "open=5"} {
+        if !strings.Contains(out, want) {
+            t.Errorf("log %q lacks %s", out, want)
+        }
+    }
+}
+
+func TestCreationLimitPerAddress(t *testing.T) {
+    mock := mockDB(t)
+    t.Setenv("CREATE_RATE_LIMIT_RPS", "0.001")
+    t.Setenv("CREATE_RATE_LIMIT_BURST", "3")
+    r, _ := newRouter(false, testAPIKeys)
+    post := func(addr, target, body string, header ...string) *httptest.ResponseRecorder {
+        req := httptest.NewRequest("POST", target, strings.NewReader(body))
+        req.RemoteAddr = addr + ":40000"
+        req.Header.Set("Content-Type", "application/json")
+        req.Header.Set("X-API-Key", "write-key")
+        for i := 0; i+1 < len(header); i += 2 {
+            req.Header.Set(header[i], header[i+1])
+        }
+        w := httptest.NewRecorder()
+        r.ServeHTTP(w, req)
+        return w
+    }
+    user := `{"name":"Ann","email":"ann@example.com"}`
+
+    for i := 1; i <= 3; i++ {
+        mock.ExpectExec("INSERT INTO users").WillReturnResult(sqlmock.NewResult(int64(i), 1))
+        if w := post("10.0.0.1", "/api/v1/users", user); w.Code != http.StatusCreated {
+            t.Fatalf("create %d: status %d: %s", i, w.Code, w.Body)
+        }
+    }
+    w := post("10.0.0.1", "/api/v1/users", user)
+    if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+        t.Errorf("fourth create: status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+    }
+    // Without TRUSTED_PROXIES a client can't pick a fresh address.
+    if w := post("10.0.0.1", "/api/v1/users", user, "X-Forwarded-For", "203.0.113.9"); w.Code != http.StatusTooManyRequests {
+        t.Errorf("create with X-Forwarded-For: status %d", w.Code)
+    }
+
+    // A bulk create costs one token per user.
+    four := `{"users":[` + strings.TrimSuffix(strings.Repeat(user+",", 4), ",") + `]}`
+    if w := post("10.0.0.2", "/api/v1/users/bulk", four); w.Code != http.StatusTooManyRequests {
+        t.Errorf("bulk of 4 over a burst of 3: status %d", w.Code)
+    }
+    mock.ExpectBegin()
+    mock.ExpectExec("INSERT INTO users").WillReturnResult(sqlmock.NewResult(10, 1))
+    mock.ExpectExec("INSERT INTO users").WillReturnResult(sqlmock.NewResult(11, 1))
+    mock.ExpectCommit()
+    if w := post("10.0.0.2", "/api/v1/users/bulk", `{"users":[`+user+","+user+`]}`); w.Code != http.StatusCreated {
+        t.Fatalf("bulk of 2: status %d: %s", w.Code, w.Body)
+    }
+    mock.ExpectExec("INSERT INTO users").WillReturnResult(sqlmock.NewResult(12, 1))
+    if w := post("10.0.0.2", "/api/v1/users", user); w.Code != http.StatusCreated {
+        t.Fatalf("create after bulk: status %d: %s", w.Code, w.Body)
+    }
+    if w := post("10.0.0.2", "/api/v1/users", user); w.Code != http.StatusTooManyRequests {
+        t.Errorf("create past the burst after bulk: status %d", w.Code)
+    }
+}
+
+func TestConsistentListReadsShareSnapshot(t *testing.T) {
+    mock := mockDB(t)
+    // One connection: a count or page read outside the snapshot's
+    // connection would wait for it forever.
+    db.SetMaxOpenConns(1)
+    setGlobal(t, &consistentListReads, true)
+    r := gin.New()
+    r.GET("/users", getUsers)
+
+    mock.ExpectExec("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ").WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectExec("START TRANSACTION WITH CONSISTENT SNAPSHOT, READ ONLY").WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM users")).WillReturnRows(sqlmock.NewRows([]string{"n"}).AddRow(2))
+    mock.ExpectQuery("FROM users").WillReturnRows(userRows(
+        User{ID: "1", Name: "Ann", Email: "ann@example.com"},
+        User{ID: "2", Name: "Bob", Email: "bob@example.com"},
+    ))
+    mock.ExpectExec("ROLLBACK").WillReturnResult(sqlmock.NewResult(0, 0))
+    done := make(chan *httptest.ResponseRecorder)
+    go func() { done <- serve(r, "GET", "/users?limit=10&with_count=true", "") }()
+    var w *httptest.ResponseRecorder
+    select {
+    case w = <-done:
+    case <-time.After(2 * time.Second):
+        t.Fatal("list reads did not all run on the snapshot connection")
+    }
+    var page struct {
+        Data []User `json:"data"`
+        Meta struct {
+            Total *int `json:"total"`
+        } `json:"meta"`
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || page.Meta.Total == nil || *page.Meta.Total != len(page.Data) {
+        t.Fatalf("status %d, body %s", w.Code, w.Body)
+    }
+
+    // Without with_count there is a single read and no snapshot.
+    mock.ExpectQuery("FROM users").WillReturnRows(userRows(User{ID: "1", Name: "Ann", Email: "ann@example.com"}))
+    if w := serve(r, "GET", "/users?limit=10", ""); w.Code != http.StatusOK {
+        t.Errorf("status %d", w.Code)
+    }
+}
+
+// onMatch is a sqlmock argument matching anything, calling f each time it
+// is matched.
+type onMatch func()
+
+func (f onMatch) Match(driver.Value) bool {
+    f()
+    return true
+}
+
+func TestPurgeStopsWhenRequestIsCanceled(t *testing.T) {
+    // Not mockDB: the second batch must be left unmet.
+    mdb, mock, err := sqlmock.New()
     if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-        return
+        t.Fatal(err)
+    }
+    defer mdb.Close()
+    setGlobal(t, &db, mdb)
+    r := gin.New()
+    r.DELETE("/users/deleted", purgeDeletedUsers)
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    batches := 0
+    // The client goes away while the first batch runs.
+    cutoff := onMatch(func() { batches++; cancel() })
+    purge := regexp.QuoteMeta("DELETE FROM users WHERE deleted_at IS NOT NULL")
+    mock.ExpectExec(purge).WithArgs(cutoff, purgeBatchSize).WillReturnResult(sqlmock.NewResult(0, purgeBatchSize))
+    mock.ExpectExec(purge).WithArgs(cutoff, purgeBatchSize).WillReturnResult(sqlmock.NewResult(0, 3))
+    r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/users/deleted?older_than=30d", nil).WithContext(ctx))
+    if batches != 1 {
+        t.Errorf("ran %d batches after the request was canceled, want 1", batches)
     }
-    c.Status(http.StatusNoContent)
 }
 
+func TestExportRejectsListOnlyParams(t *testing.T) {
+    mockDB(t)
+    r := exportRouter()
+    for _, param := range exportUnsupportedParams {
+        w := serve(r, "GET", "/users/export?format=csv&"+param+"=1", "")
+        if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), param) {
+            t.Errorf("%s: status %d, body %s", param, w.Code, w.Body)
+        }
+    }
+}
 EOL
 
 # Create Dockerfile
@@ -194,8 +6995,11 @@ FROM golang:1.22.2-alpine AS builder
 
 WORKDIR /app
 
+# Build tags, e.g. --build-arg BUILD_TAGS=mymysql for the alternative driver
+ARG BUILD_TAGS=""
+
 # Copy go mod and sum files
-COPY ./main.go ./main.go
+COPY ./*.go ./
 
 # Download any dependencies
 RUN go mod init example/api
@@ -216,7 +7020,7 @@ RUN swag --version
 RUN swag init
 
 # Build the Go app
-RUN go build -o main .
+RUN go build -tags "\${BUILD_TAGS}" -o main .
 
 # Start a new stage from scratch
 FROM alpine:latest
@@ -249,6 +7053,8 @@ services:
       - DB_USER=root
       - DB_PASSWORD=rootpassword
       - DB_NAME=userdb
+      - ID_STRATEGY=${ID_STRATEGY:-autoincrement}
+      - 'DEPRECATED_FIELDS={"meta.offset":"page with the Link header instead"}'
 
   db:
     image: mariadb:10.5
@@ -263,17 +7069,49 @@ volumes:
   mariadb_data:
 EOL
 
+# Pick the users.id column for ID_STRATEGY (autoincrement or uuid)
+ID_STRATEGY=${ID_STRATEGY:-autoincrement}
+if [ "$ID_STRATEGY" = "uuid" ]; then
+  ID_COLUMN="id CHAR(36) PRIMARY KEY"
+  SEED_ID_COLUMN="id, "
+  SEED_ID_VALUE="UUID(), "
+else
+  ID_COLUMN="id INT AUTO_INCREMENT PRIMARY KEY"
+  SEED_ID_COLUMN=""
+  SEED_ID_VALUE=""
+fi
+
 # Create init.sql
 cat > init.sql << EOL
 CREATE TABLE IF NOT EXISTS users (
-  id INT AUTO_INCREMENT PRIMARY KEY,
+  ${ID_COLUMN},
   name VARCHAR(100) NOT NULL,
-  email VARCHAR(100) NOT NULL
+  email VARCHAR(255) NOT NULL,
+  email_hash CHAR(64) NULL,
+  created_by VARCHAR(100) NULL,
+  deleted_at DATETIME NULL,
+  tenant_id VARCHAR(64) NULL,
+  updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  INDEX idx_users_email_hash (email_hash),
+  INDEX idx_users_created_by (created_by),
+  INDEX idx_users_deleted_at (deleted_at),
+  INDEX idx_users_tenant_id (tenant_id),
+  INDEX idx_users_updated_at (updated_at)
+);
+
+CREATE TABLE IF NOT EXISTS user_read_audit (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  user_id VARCHAR(36) NOT NULL,
+  accessor VARCHAR(100) NULL,
+  tenant_id VARCHAR(64) NULL,
+  request_id VARCHAR(64) NOT NULL,
+  read_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  INDEX idx_user_read_audit_user_id (user_id, read_at)
 );
 
-INSERT INTO users (name, email) VALUES 
-  ('John Doe', 'john@example.com'),
-  ('Jane Smith', 'jane@example.com');
+INSERT INTO users (${SEED_ID_COLUMN}name, email) VALUES 
+  (${SEED_ID_VALUE}'John Doe', 'john@example.com'),
+  (${SEED_ID_VALUE}'Jane Smith', 'jane@example.com');
 EOL
 
 # Initialize Go module
@@ -282,9 +7120,14 @@ go mod init example/api
 # Add dependencies
 go get github.com/gin-gonic/gin
 go get github.com/go-sql-driver/mysql
+go get github.com/ziutek/mymysql/godrv
 go get github.com/swaggo/swag/cmd/swag
 go get github.com/swaggo/gin-swagger
 go get github.com/swaggo/files
+go get github.com/parquet-go/parquet-go
+go get github.com/google/uuid
+go get github.com/prometheus/client_golang
+go get github.com/DATA-DOG/go-sqlmock
 
 # Ensure all dependencies are properly recorded
 go mod tidy